@@ -0,0 +1,243 @@
+// Write the recipe catalog in a machine readable format.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// catalogRecipe is the machine readable form of a recipe.
+type catalogRecipe struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace,omitempty"`
+	File      string            `json:"file"`
+	Dir       string            `json:"dir,omitempty"`
+	Shadowed  bool              `json:"shadowed,omitempty"`
+	Brief     string            `json:"brief"`
+	Full      string            `json:"full"`
+	Timeout   string            `json:"timeout,omitempty"`
+	Variables []catalogVariable `json:"variables"`
+	Steps     []catalogStep     `json:"steps"`
+	Finally   []catalogStep     `json:"finally,omitempty"`
+}
+
+// catalogVariable is a recipe variable. A variable is required if it does
+// not have a default value.
+type catalogVariable struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Doc      string `json:"doc,omitempty"`
+	Short    string `json:"short,omitempty"`
+	List     bool   `json:"list,omitempty"`
+	Secret   bool   `json:"secret,omitempty"`
+	Default  string `json:"default"`
+	Required bool   `json:"required"`
+}
+
+// catalogStep is a recipe step with its location in the recipe file.
+type catalogStep struct {
+	Directive string `json:"directive"`
+	Data      string `json:"data"`
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Timeout   string `json:"timeout,omitempty"`
+	Retry     int    `json:"retry,omitempty"`
+	Backoff   string `json:"backoff,omitempty"`
+}
+
+// newCatalogRecipe converts a recipe to its machine readable form.
+// The built-in variables are not included.
+func newCatalogRecipe(recipe RecipeInfo) (cr catalogRecipe) {
+	cr.Name = recipe.Name
+	cr.Namespace = recipe.Namespace
+	cr.File = recipe.File
+	cr.Dir = recipe.Dir
+	cr.Shadowed = recipe.Shadowed
+	cr.Brief = recipe.Brief
+	cr.Full = recipe.Full
+	if recipe.Timeout > 0 {
+		cr.Timeout = recipe.Timeout.String()
+	}
+
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	ks := []string{}
+	for k := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) == false {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	cr.Variables = []catalogVariable{}
+	for _, k := range ks {
+		v := recipe.Variables[k]
+		d := recipe.Decls[k]
+		cv := catalogVariable{Name: k, Type: d.Type.String(), Doc: d.Doc, Short: d.Short, List: d.List, Secret: d.Secret, Default: v, Required: v == ""}
+		if d.Secret && d.Source == "" && v != "" {
+			cv.Default = secretMask
+		}
+		cr.Variables = append(cr.Variables, cv)
+	}
+
+	cr.Steps = newCatalogSteps(recipe.Steps)
+	if len(recipe.Finally) > 0 {
+		cr.Finally = newCatalogSteps(recipe.Finally)
+	}
+	return
+}
+
+// newCatalogSteps converts the steps to their machine readable form.
+func newCatalogSteps(steps []RecipeStep) []catalogStep {
+	cs := []catalogStep{}
+	for _, step := range steps {
+		s := catalogStep{
+			Directive: step.DirectiveString,
+			Data:      step.Data,
+			Line:      step.Line.lineno,
+			Retry:     step.Retry,
+		}
+		if step.Line.fi != nil {
+			s.File = step.Line.fi.abspath
+		}
+		if step.Timeout > 0 {
+			s.Timeout = step.Timeout.String()
+		}
+		if step.Backoff > 0 {
+			s.Backoff = step.Backoff.String()
+		}
+		cs = append(cs, s)
+	}
+	return cs
+}
+
+// writeCatalog writes the recipes to stdout in the format, json or yaml.
+// A single recipe is written as an object, a list of recipes is written
+// as an array.
+func writeCatalog(format string, recipes []RecipeInfo, single bool) error {
+	crs := []catalogRecipe{}
+	for _, recipe := range recipes {
+		crs = append(crs, newCatalogRecipe(recipe))
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		var v interface{} = crs
+		if single {
+			v = crs[0]
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteString("\n")
+	case "yaml":
+		if single {
+			yamlRecipe(&buf, crs[0], "")
+		} else if len(crs) == 0 {
+			buf.WriteString("[]\n")
+		} else {
+			for _, cr := range crs {
+				yamlRecipe(&buf, cr, "- ")
+			}
+		}
+	default:
+		return &UsageError{Msg: fmt.Sprintf("unsupported format '%v', expected text, json or yaml", format)}
+	}
+	fmt.Print(buf.String())
+	return nil
+}
+
+// yamlRecipe writes a recipe as a YAML mapping. The first key is prefixed
+// by lead, it is "- " for a list item, and the other keys are indented to
+// match it.
+func yamlRecipe(buf *bytes.Buffer, cr catalogRecipe, lead string) {
+	in := strings.Repeat(" ", len(lead))
+	key := func(k string) string {
+		if lead != "" {
+			p := lead
+			lead = ""
+			return p + k
+		}
+		return in + k
+	}
+	fmt.Fprintf(buf, "%v: %v\n", key("name"), yamlString(cr.Name))
+	if cr.Namespace != "" {
+		fmt.Fprintf(buf, "%v: %v\n", key("namespace"), yamlString(cr.Namespace))
+	}
+	fmt.Fprintf(buf, "%v: %v\n", key("file"), yamlString(cr.File))
+	if cr.Dir != "" {
+		fmt.Fprintf(buf, "%v: %v\n", key("dir"), yamlString(cr.Dir))
+	}
+	if cr.Shadowed {
+		fmt.Fprintf(buf, "%v: true\n", key("shadowed"))
+	}
+	fmt.Fprintf(buf, "%v: %v\n", key("brief"), yamlString(cr.Brief))
+	fmt.Fprintf(buf, "%v: %v\n", key("full"), yamlString(cr.Full))
+	if cr.Timeout != "" {
+		fmt.Fprintf(buf, "%v: %v\n", key("timeout"), yamlString(cr.Timeout))
+	}
+	if len(cr.Variables) == 0 {
+		fmt.Fprintf(buf, "%v: []\n", key("variables"))
+	} else {
+		fmt.Fprintf(buf, "%v:\n", key("variables"))
+		for _, v := range cr.Variables {
+			fmt.Fprintf(buf, "%v  - name: %v\n", in, yamlString(v.Name))
+			if v.Type != "" {
+				fmt.Fprintf(buf, "%v    type: %v\n", in, yamlString(v.Type))
+			}
+			if v.Doc != "" {
+				fmt.Fprintf(buf, "%v    doc: %v\n", in, yamlString(v.Doc))
+			}
+			if v.Short != "" {
+				fmt.Fprintf(buf, "%v    short: %v\n", in, yamlString(v.Short))
+			}
+			if v.List {
+				fmt.Fprintf(buf, "%v    list: true\n", in)
+			}
+			if v.Secret {
+				fmt.Fprintf(buf, "%v    secret: true\n", in)
+			}
+			fmt.Fprintf(buf, "%v    default: %v\n", in, yamlString(v.Default))
+			fmt.Fprintf(buf, "%v    required: %v\n", in, v.Required)
+		}
+	}
+	yamlSteps(buf, key("steps"), in, cr.Steps)
+	if len(cr.Finally) > 0 {
+		yamlSteps(buf, key("finally"), in, cr.Finally)
+	}
+}
+
+// yamlSteps writes a list of steps.
+func yamlSteps(buf *bytes.Buffer, key string, in string, steps []catalogStep) {
+	if len(steps) == 0 {
+		fmt.Fprintf(buf, "%v: []\n", key)
+		return
+	}
+	fmt.Fprintf(buf, "%v:\n", key)
+	for _, s := range steps {
+		fmt.Fprintf(buf, "%v  - directive: %v\n", in, yamlString(s.Directive))
+		fmt.Fprintf(buf, "%v    data: %v\n", in, yamlString(s.Data))
+		fmt.Fprintf(buf, "%v    file: %v\n", in, yamlString(s.File))
+		fmt.Fprintf(buf, "%v    line: %v\n", in, s.Line)
+		if s.Timeout != "" {
+			fmt.Fprintf(buf, "%v    timeout: %v\n", in, yamlString(s.Timeout))
+		}
+		if s.Retry > 0 {
+			fmt.Fprintf(buf, "%v    retry: %v\n", in, s.Retry)
+		}
+		if s.Backoff != "" {
+			fmt.Fprintf(buf, "%v    backoff: %v\n", in, yamlString(s.Backoff))
+		}
+	}
+}
+
+// yamlString quotes a string for YAML. The double quoted YAML style
+// accepts the same escapes as Go so the strings are always quoted, that
+// avoids the special cases for strings like "yes", "1.0" and ": ".
+func yamlString(s string) string {
+	return strconv.Quote(s)
+}
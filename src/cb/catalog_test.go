@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCatalogStepModifiers(t *testing.T) {
+	recipe := testLoadRecipe(t, `[description]
+brief = catalog
+full = catalog
+
+[step]
+step = timeout=30s retry=3 backoff=5s exec curl -s -O http://example.com
+step = info done
+`)
+	cs := newCatalogSteps(recipe.Steps)
+	data, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"timeout":"30s"`, `"retry":3`, `"backoff":"5s"`} {
+		if strings.Contains(string(data), s) == false {
+			t.Errorf("json does not contain %v: %s", s, data)
+		}
+	}
+	if strings.Count(string(data), "backoff") != 1 {
+		t.Errorf("json has a backoff for a step without one: %s", data)
+	}
+
+	var buf bytes.Buffer
+	yamlSteps(&buf, "steps", "", cs)
+	for _, s := range []string{`    timeout: "30s"`, `    retry: 3`, `    backoff: "5s"`} {
+		if strings.Contains(buf.String(), s+"\n") == false {
+			t.Errorf("yaml does not contain %v:\n%v", s, buf.String())
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Generate shell completion scripts.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// completionOptions are the options that are completed before the recipe.
+var completionOptions = []string{
+	"--banner",
+	"--completion",
+	"--dry-run",
+	"--flatten",
+	"--format",
+	"--help",
+	"--list",
+	"--no-banner",
+	"--no-tee",
+	"--quiet",
+	"--recipes",
+	"--search",
+	"--shell",
+	"--tee",
+	"--verbose",
+	"--version",
+}
+
+// completion writes the completion script for a shell to stdout.
+// The scripts call back into cb to get the recipe names and the recipe
+// options so that they are always up to date:
+//     --complete-recipes           List the recipe names.
+//     --complete-options RECIPE    List the recipe options, each line is
+//                                  the option and the default value
+//                                  separated by a tab.
+// The -r options on the command line are passed to the callbacks.
+func completion(shell string) error {
+	var s string
+	switch shell {
+	case "bash":
+		s = completionBash
+	case "zsh":
+		s = completionZsh
+	case "fish":
+		s = completionFish
+	default:
+		return &UsageError{Msg: fmt.Sprintf("unsupported shell '%v' for --completion, expected bash, zsh or fish", shell)}
+	}
+	fn := strings.Replace(Context.Base, "-", "_", -1)
+	fmt.Printf(s, Context.Base, fn, strings.Join(completionOptions, " "))
+	return nil
+}
+
+// completeRecipes lists the recipe names for the completion scripts.
+// Shadowed recipes are not listed because they cannot be run.
+func completeRecipes() error {
+	recipes, err := loadAllRecipes()
+	if err != nil {
+		return err
+	}
+	for _, recipe := range recipes {
+		if recipe.Shadowed == false {
+			fmt.Printf("%v\n", recipe.Name)
+		}
+	}
+	return nil
+}
+
+// completeOptions lists the options for a recipe with their descriptions
+// and default values for the completion scripts.
+func completeOptions(recipeRef string) error {
+	recipe, err := loadRecipe(recipeRef)
+	if err != nil {
+		return err
+	}
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	ks := []string{}
+	for k := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) == false {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		desc := "required"
+		if v := recipe.Variables[k]; v != "" && recipe.Decls[k].Secret && recipe.Decls[k].Source == "" {
+			desc = "default: " + secretMask
+		} else if v != "" {
+			desc = "default: " + strings.Replace(v, "\n", " ", -1)
+		}
+		if doc := recipe.Decls[k].Doc; doc != "" {
+			desc = fmt.Sprintf("%v (%v)", strings.Replace(doc, "\n", " ", -1), desc)
+		}
+		fmt.Printf("--%v\t%v\n", k, completionTruncate(desc, 60))
+		if recipe.Decls[k].Type.Kind == "bool" {
+			fmt.Printf("--no-%v\tclear %v\n", k, k)
+		}
+	}
+	return nil
+}
+
+// completionTruncate shortens a description to n characters, not bytes,
+// so that a multibyte character is not split.
+func completionTruncate(desc string, n int) string {
+	r := []rune(desc)
+	if len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return desc
+}
+
+// completionBash is the bash completion script.
+// The arguments are the program name, the function name prefix and the
+// program options.
+const completionBash = `# bash completion for %[1]v
+# Add this to ~/.bashrc:
+#     source <(%[1]v --completion bash)
+_%[2]v_complete() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local i recipe=""
+    local args=()
+    for ((i = 1; i < COMP_CWORD; i++)) ; do
+        case "${COMP_WORDS[i]}" in
+            -r|--recipes) args+=(-r "${COMP_WORDS[i+1]}") ; ((i++)) ;;
+            -f|--flatten|-s|--shell|--completion|--format) ((i++)) ;;
+            -*) ;;
+            *) recipe="${COMP_WORDS[i]}" ; break ;;
+        esac
+    done
+    if [ -z "${recipe}" ] ; then
+        if [[ "${cur}" == -* ]] ; then
+            COMPREPLY=($(compgen -W "%[3]v" -- "${cur}"))
+        else
+            COMPREPLY=($(compgen -W "$(%[1]v "${args[@]}" --complete-recipes 2>/dev/null)" -- "${cur}"))
+        fi
+    else
+        COMPREPLY=($(compgen -W "$(%[1]v "${args[@]}" --complete-options "${recipe}" 2>/dev/null | cut -f1)" -- "${cur}"))
+    fi
+}
+complete -o default -F _%[2]v_complete %[1]v
+`
+
+// completionZsh is the zsh completion script.
+const completionZsh = `#compdef %[1]v
+# zsh completion for %[1]v
+# Add this to ~/.zshrc after compinit:
+#     source <(%[1]v --completion zsh)
+_%[2]v() {
+    local i recipe=""
+    local -a args items
+    for ((i = 2; i < CURRENT; i++)) ; do
+        case "${words[i]}" in
+            -r|--recipes) args+=(-r "${words[i+1]}") ; ((i++)) ;;
+            -f|--flatten|-s|--shell|--completion|--format) ((i++)) ;;
+            -*) ;;
+            *) recipe="${words[i]}" ; break ;;
+        esac
+    done
+    if [[ -z "${recipe}" ]] ; then
+        if [[ "${words[CURRENT]}" == -* ]] ; then
+            items=(%[3]v)
+        else
+            items=(${(f)"$(%[1]v "${args[@]}" --complete-recipes 2>/dev/null)"})
+        fi
+        compadd -a items
+    else
+        local opt desc
+        while IFS=$'\t' read -r opt desc ; do
+            items+=("${opt}:${desc//:/\\:}")
+        done < <(%[1]v "${args[@]}" --complete-options "${recipe}" 2>/dev/null)
+        _describe 'recipe option' items
+    fi
+}
+compdef _%[2]v %[1]v
+`
+
+// completionFish is the fish completion script.
+const completionFish = `# fish completion for %[1]v
+# Add this to ~/.config/fish/config.fish:
+#     %[1]v --completion fish | source
+function __%[2]v_args
+    set -l tokens (commandline -opc)
+    for i in (seq 2 (count $tokens))
+        switch $tokens[$i]
+            case -r --recipes
+                echo -r
+                echo $tokens[(math $i + 1)]
+        end
+    end
+end
+function __%[2]v_recipe
+    set -l tokens (commandline -opc)
+    set -l skip 0
+    for t in $tokens[2..-1]
+        if test $skip -eq 1
+            set skip 0
+            continue
+        end
+        switch $t
+            case -r --recipes -f --flatten -s --shell --completion --format
+                set skip 1
+            case '-*'
+            case '*'
+                echo $t
+                return 0
+        end
+    end
+    return 1
+end
+complete -c %[1]v -f -n 'not __%[2]v_recipe' -a '(%[1]v (__%[2]v_args) --complete-recipes 2>/dev/null)'
+complete -c %[1]v -f -n 'not __%[2]v_recipe' -a '%[3]v'
+complete -c %[1]v -f -n '__%[2]v_recipe' -a '(%[1]v (__%[2]v_args) --complete-options (__%[2]v_recipe) 2>/dev/null)'
+`
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCompletionTruncate(t *testing.T) {
+	tests := []struct {
+		desc string
+		n    int
+		want string
+	}{
+		{"default: world", 60, "default: world"},
+		{"abcdefghij", 10, "abcdefghij"},
+		{"abcdefghijk", 10, "abcdefg..."},
+		{"déploiement rapide", 10, "déploie..."},
+		{"ȺȺȺȺȺȺȺȺȺȺȺ", 10, "ȺȺȺȺȺȺȺ..."},
+	}
+	for _, tt := range tests {
+		got := completionTruncate(tt.desc, tt.n)
+		if got != tt.want || utf8.ValidString(got) == false {
+			t.Errorf("completionTruncate(%q, %v) = %q, want %q", tt.desc, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Read the user and project configuration files.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readConfig sets the default options from the configuration files before
+// the command line options are parsed. The user configuration file is
+// ~/.cbrc, the project configuration file is the closest .cbrc in the
+// current directory or one of its parents. The project settings override
+// the user settings.
+//
+// The configuration files use the recipe INI syntax with a single
+// [options] section:
+//     [options]
+//     verbose = 2          # 0 (quiet) to 3, like -q, -v and -vv
+//     tee = true           # like -t
+//     banner = false       # like --no-banner
+//     recipes = ~/recipes  # like -r, can be specified multiple times
+//     scripts = ~/.cb      # the anonymous script directory
+//     logs = ~/logs        # the directory for the -t log files
+//
+// Relative paths are relative to the directory of the configuration file.
+// It returns the recipe directories, the project ones come first.
+func readConfig(opts *CliOptions) (dirs []string, err error) {
+	fns := []string{}
+	home := os.Getenv("HOME")
+	base := filepath.Base(os.Args[0])
+	rc := "." + base + "rc"
+	if home != "" {
+		if fn := filepath.Join(home, rc); IsFile(fn) {
+			fns = append(fns, fn)
+		}
+	}
+	if wd, e := os.Getwd(); e == nil {
+		if fn := findConfigFile(wd, rc); fn != "" && (len(fns) == 0 || fn != fns[0]) {
+			fns = append(fns, fn)
+		}
+	}
+
+	for _, fn := range fns {
+		ds, e := readConfigFile(fn, opts)
+		if e != nil {
+			err = e
+			return
+		}
+		dirs = append(ds, dirs...) // the project directories come first
+		opts.ConfigFiles = append(opts.ConfigFiles, fn)
+	}
+	return
+}
+
+// findConfigFile looks for the project configuration file in the
+// directory and its parents, the closest one wins.
+func findConfigFile(dir string, rc string) string {
+	for {
+		fn := filepath.Join(dir, rc)
+		if IsFile(fn) {
+			return fn
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfigFile reads a configuration file and updates the options.
+func readConfigFile(fn string, opts *CliOptions) (dirs []string, err error) {
+	nested := map[string]int{}
+	lines, err := readRecipeFile(fn, nested)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(fn)
+	section := ""
+	for _, li := range lines {
+		if li.line[0] == '[' {
+			section = li.line
+			if section != "[options]" {
+				err = newParseError(li, "invalid section found: %v", section)
+				return
+			}
+			continue
+		}
+		if section == "" {
+			err = newParseError(li, "orphan declaration '%v'", li.line)
+			return
+		}
+		if strings.Contains(li.line, "=") == false {
+			err = newParseError(li, "syntax error, missing '=' in '%v'", li.line)
+			return
+		}
+		key, value, e := getRecipeAssignmentValue(li)
+		if e != nil {
+			err = e
+			return
+		}
+		switch key {
+		case "verbose":
+			n, e := strconv.Atoi(value)
+			if e != nil || n < 0 || n > 3 {
+				err = newParseError(li, "invalid verbose '%v', expected 0, 1, 2 or 3", value)
+				return
+			}
+			opts.Verbose = n
+		case "tee", "banner":
+			b, e := strconv.ParseBool(value)
+			if e != nil {
+				err = newParseError(li, "invalid %v '%v', expected true or false", key, value)
+				return
+			}
+			if key == "tee" {
+				opts.Tee = b
+			} else {
+				opts.Banner = b
+			}
+		case "recipes":
+			d := getConfigPath(dir, value)
+			if IsDir(d) == false {
+				err = newParseError(li, "not a valid directory: %v", d)
+				return
+			}
+			dirs = append(dirs, d)
+		case "scripts":
+			opts.ScriptDir = getConfigPath(dir, value)
+		case "logs":
+			opts.LogDir = getConfigPath(dir, value)
+		default:
+			err = newParseError(li, "unknown option '%v'", key)
+			return
+		}
+	}
+	return
+}
+
+// getConfigPath expands a leading ~ and makes relative paths relative to
+// the directory of the configuration file.
+func getConfigPath(dir string, value string) string {
+	if value == "~" || strings.HasPrefix(value, "~/") {
+		value = fmt.Sprintf("%v%v", os.Getenv("HOME"), value[1:])
+	}
+	if filepath.IsAbs(value) == false {
+		value = filepath.Join(dir, value)
+	}
+	return value
+}
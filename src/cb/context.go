@@ -26,6 +26,7 @@ type ContextInfoStruct struct {
 	OsVersion     string
 	Pwd           string
 	RecipeDir     string
+	RecipePath    []string
 	ScriptDir     string
 	Tee           string
 	Time          string
@@ -78,6 +79,7 @@ func MakeContext(tee string) {
 	Context.OsVersion = osver
 	Context.Pwd = d
 	Context.RecipeDir = rp
+	Context.RecipePath = []string{rp}
 	Context.ScriptDir = sd
 	Context.Tee = tee
 	Context.Time = t
@@ -92,6 +94,64 @@ func MakeContext(tee string) {
 	return
 }
 
+// SetRecipePath sets the directories that are searched for recipes. The
+// directories specified by -r are searched first, in the order that they
+// were specified, followed by the project recipes directory, the
+// directories in the CB_RECIPE_PATH environment variable and the default
+// recipes directory. The first directory is the recipes directory.
+func (info *ContextInfoStruct) SetRecipePath(dirs []string) {
+	rp := append([]string{}, dirs...)
+	if pd := findProjectRecipeDir(info.Pwd, info.Base); pd != "" {
+		Log.Info("project recipes directory: %v", pd)
+		rp = append(rp, pd)
+	}
+	ev := strings.ToUpper(fmt.Sprintf("%v_RECIPE_PATH", info.Base))
+	for _, dir := range strings.Split(os.Getenv(ev), ":") {
+		if dir != "" {
+			rp = append(rp, dir)
+		}
+	}
+	rp = append(rp, info.RecipeDir)
+
+	// Use absolute paths so that the path is still valid after a cd step.
+	// Remove the duplicates, the first one wins.
+	info.RecipePath = []string{}
+	seen := map[string]bool{}
+	for _, dir := range rp {
+		if a, err := filepath.Abs(dir); err == nil {
+			dir = a
+		}
+		if seen[dir] == false {
+			seen[dir] = true
+			info.RecipePath = append(info.RecipePath, dir)
+		}
+	}
+	info.RecipeDir = info.RecipePath[0]
+}
+
+// findProjectRecipeDir looks for the project recipes directory in the
+// directory and its parents, like git does for .git. The project recipes
+// directory is .cb/recipes or cbrecipes, the closest one wins.
+func findProjectRecipeDir(dir string, base string) string {
+	names := []string{
+		filepath.Join("."+base, "recipes"),
+		base + "recipes",
+	}
+	for {
+		for _, name := range names {
+			pd := filepath.Join(dir, name)
+			if IsDir(pd) {
+				return pd
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
 // PrintContext prints the container information.
 func (info ContextInfoStruct) PrintContext() {
 	Log.Info("context")
@@ -104,7 +164,7 @@ func (info ContextInfoStruct) PrintContext() {
 	Log.Info("   osver    : %v", info.OsVersion)
 	Log.Info("   pid      : %v", info.UserPID)
 	Log.Info("   pwd      : %v", info.Pwd)
-	Log.Info("   recipes  : %v", info.RecipeDir)
+	Log.Info("   recipes  : %v", strings.Join(info.RecipePath, ":"))
 	Log.Info("   scripts  : %v", info.ScriptDir)
 	if info.Tee != "" {
 		Log.Info("   tee      : %v", info.Tee)
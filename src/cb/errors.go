@@ -0,0 +1,198 @@
+// The errors returned by the recipe loader and runner.
+// They are reported by main which decides how to exit.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// The exit codes for each class of failure.
+// A failed step exits with the exit code of the command, if there is one.
+// The codes for the failures that are detected by cb are in the range of
+// sysexits.h, 64 to 78, so that they do not collide with the small exit
+// codes that commands normally use.
+const (
+	exitFailure     = 1   // a failure that does not fit into another class
+	exitUsage       = 64  // invalid command line option, EX_USAGE
+	exitParse       = 65  // syntax or semantic error in the recipe, EX_DATAERR
+	exitNotFound    = 66  // the recipe does not exist, EX_NOINPUT
+	exitVariable    = 78  // a variable does not have a valid value, EX_CONFIG
+	exitTimeout     = 124 // a step or the recipe timed out
+	exitInterrupted = 130 // the user interrupted the recipe
+)
+
+// exitCode returns the exit code for an error.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *UsageError:
+		return exitUsage
+	case *NotFoundError:
+		return exitNotFound
+	case *ParseError:
+		return exitParse
+	case *VariableError, *VariableTypeError, *VariableRefError:
+		return exitVariable
+	case *StepError:
+		switch {
+		case e.Timeout():
+			return exitTimeout
+		case e.Interrupted():
+			return exitInterrupted
+		case e.Code > 0 && e.Code < 256:
+			return e.Code
+		}
+	}
+	return exitFailure
+}
+
+// UsageError is an invalid recipe option on the command line.
+type UsageError struct {
+	Msg string
+}
+
+// Error reports the error.
+func (e *UsageError) Error() string {
+	return e.Msg
+}
+
+// NotFoundError reports that a recipe does not exist.
+// Path is the recipe search path for recipes that were referenced by name.
+type NotFoundError struct {
+	File string
+	Path []string
+}
+
+// Error reports the error.
+func (e *NotFoundError) Error() string {
+	if len(e.Path) > 0 {
+		return fmt.Sprintf("recipe '%v' not found in the recipe path: %v", e.File, strings.Join(e.Path, ":"))
+	}
+	return fmt.Sprintf("recipe file does not exist: %v", e.File)
+}
+
+// ParseError is a syntax or semantic error in a recipe file.
+// Line is not set for errors that are not associated with a line, like
+// a missing [description] field, File is used instead.
+type ParseError struct {
+	Line LineInfo
+	File string
+	Msg  string
+}
+
+// Error reports the error with the location.
+func (e *ParseError) Error() string {
+	if e.Line.fi != nil {
+		return fmt.Sprintf("%v at line %v in %v", e.Msg, e.Line.lineno, e.Line.fi.abspath)
+	}
+	if e.File != "" {
+		return fmt.Sprintf("%v in %v", e.Msg, e.File)
+	}
+	return e.Msg
+}
+
+// newParseError creates a parse error for a line.
+func newParseError(li LineInfo, f string, a ...interface{}) error {
+	return &ParseError{Line: li, Msg: fmt.Sprintf(f, a...)}
+}
+
+// StepError is a step failure.
+// Code is the exit code of the command for exec and script steps, it is
+// zero for the other steps. Err is the underlying error, it is the
+// context error if the step or the recipe timed out or was interrupted.
+type StepError struct {
+	Step int
+	Line LineInfo
+	Code int
+	Msg  string
+	Err  error
+}
+
+// newStepError creates a step error with the location of the step.
+func newStepError(step RecipeStep, stepi int, f string, a ...interface{}) *StepError {
+	li := step.Line
+	msg := fmt.Sprintf(f, a...)
+	if li.fi != nil {
+		msg = fmt.Sprintf("%v at line %v in %v", msg, li.lineno, li.fi.abspath)
+	}
+	return &StepError{Step: stepi, Line: li, Msg: msg}
+}
+
+// Error reports the error.
+func (e *StepError) Error() string {
+	return e.Msg
+}
+
+// Timeout reports whether the step failed because the step or the recipe
+// timed out.
+func (e *StepError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
+
+// Interrupted reports whether the step failed because the recipe was
+// interrupted.
+func (e *StepError) Interrupted() bool {
+	return e.Err == context.Canceled
+}
+
+// VariableError reports required variables that do not have values.
+type VariableError struct {
+	Names []string
+}
+
+// Error reports the error.
+func (e *VariableError) Error() string {
+	opts := []string{}
+	for _, name := range e.Names {
+		opts = append(opts, "--"+name)
+	}
+	return fmt.Sprintf("unset variables found, cannot continue, these options have no value: %v", strings.Join(opts, ", "))
+}
+
+// VariableTypeError reports a variable value that is not valid for the
+// type of the variable. Line is where the variable was declared.
+type VariableTypeError struct {
+	Line  LineInfo
+	Name  string
+	Value string
+	Type  string
+	Msg   string
+}
+
+// Error reports the error with the location of the declaration.
+func (e *VariableTypeError) Error() string {
+	msg := fmt.Sprintf("invalid value '%v' for --%v of type %v: %v", e.Value, e.Name, e.Type, e.Msg)
+	if e.Line.fi != nil {
+		msg = fmt.Sprintf("%v, declared at line %v in %v", msg, e.Line.lineno, e.Line.fi.abspath)
+	}
+	return msg
+}
+
+// VariableRefError reports a variable reference that failed, like
+// ${name:?message} when name does not have a value. Line is where the
+// variable was declared or, if Step is set, the step that has the
+// reference.
+type VariableRefError struct {
+	Line LineInfo
+	Name string
+	Step int
+	Err  error
+}
+
+// Error reports the error with the location of the declaration.
+func (e *VariableRefError) Error() string {
+	if e.Step > 0 {
+		if e.Line.fi != nil {
+			return fmt.Sprintf("%v at line %v in %v", e.Err, e.Line.lineno, e.Line.fi.abspath)
+		}
+		return e.Err.Error()
+	}
+	msg := fmt.Sprintf("invalid value for --%v: %v", e.Name, e.Err)
+	if e.Line.fi != nil {
+		msg = fmt.Sprintf("%v, declared at line %v in %v", msg, e.Line.lineno, e.Line.fi.abspath)
+	}
+	return msg
+}
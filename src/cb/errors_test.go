@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCodeParse(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"nested.ini":  "include nested.ini\n",
+		"section.ini": "[bogus]\n",
+		"include.ini": "include missing.ini\n",
+	}
+	for name, text := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadRecipe(fn)
+		if code := exitCode(err); code != exitParse {
+			t.Errorf("%v: exit code %v, want %v (%v)", name, code, exitParse, err)
+		}
+	}
+}
+
+func TestExitCodeRun(t *testing.T) {
+	tests := []struct {
+		name string
+		step string
+		want int
+	}{
+		{"passed", "exec true", 0},
+		{"command", "exec /bin/sh -c 'exit 3'", 3},
+		{"builtin", "must-exist-file /does/not/exist", exitFailure},
+		{"required", "info ${env:CB_TEST_NOPE:?CB_TEST_NOPE is required}", exitVariable},
+	}
+	for _, tt := range tests {
+		recipe := testLoadRecipe(t, `[description]
+brief = exit
+full = exit
+
+[step]
+step = `+tt.step+"\n")
+		_, err := testRunRecipe(t, recipe)
+		if code := exitCode(err); code != tt.want {
+			t.Errorf("%v: exit code %v, want %v (%v)", tt.name, code, tt.want, err)
+		}
+	}
+}
@@ -8,16 +8,31 @@ import (
 )
 
 //  help generates the help message.
-func help(opts CliOptions) {
+func help(opts CliOptions) error {
 	if opts.HelpArg == "" {
+		if opts.Format != "text" {
+			return &UsageError{Msg: fmt.Sprintf("--format %v requires a recipe: help <recipe> --format %v", opts.Format, opts.Format)}
+		}
 		helpTop()
 	} else {
 		// generate the help for a recipe
-		recipe := loadRecipe(opts.HelpArg)
+		recipe, err := loadRecipe(opts.HelpArg)
+		if err != nil {
+			return err
+		}
+		if opts.Format != "text" {
+			return writeCatalog(opts.Format, []RecipeInfo{recipe}, true)
+		}
 		fmt.Printf("Help for %v - %v\n", recipe.Name, recipe.File)
+		if recipe.Namespace != "" {
+			fmt.Printf("Namespace: %v\n", recipe.Namespace)
+		}
 		fmt.Printf("%v\n", recipe.Full)
+		if o := recipeOptionsHelp(recipe); o != "" {
+			fmt.Printf("%v\n", o)
+		}
 	}
-	os.Exit(0)
+	return nil
 }
 
 // helpTop generates the top level help.
@@ -91,16 +106,21 @@ RECIPES
     Include files can include other files. Include files must not have a .ini
     extension. The recommended extension is .inc but anything will work.
 
-    Recipes have three sections:
+    Recipes have three sections and an optional fourth one:
 
         [description]  Fields that describe the recipe.
         [variable]     Defines variables for the recipe.
         [steo]         Defines the recipe steps.
+        [finally]      Defines cleanup steps that always run.
 
     The description section contains two variable: brief and full. Brief is a
     one line description of the recipe. Full is a full multiline description.
     You can use """ """ syntax for the full description.
 
+    The description section can also define an optional timeout for the
+    whole recipe, like "timeout = 1h". If the recipe runs longer than that
+    the running command is killed and the recipe fails.
+
     The variable section defines variables that the user can change. Each
     variable has a name and an optional value separated by an equals '=' sign.
 
@@ -111,6 +131,76 @@ RECIPES
     are not optional. If the variables are assigned a value, that is the default
     value. If they are not assigned a value, then they are required.
 
+    A variable value can reference other variables. The references are
+    resolved after the command line options are applied, each variable is
+    resolved after the variables that it references so the order of the
+    declarations does not matter. A reference cycle, like a = ${b} and
+    b = ${a}, or a reference to a variable that does not exist is an error
+    that is reported at the line where the variable was declared. If the
+    reference is in a value from the command line, like --a '${nope}', the
+    error is reported for the option. In the steps, references to names
+    that are not variables are left as they are and a warning is reported
+    because it is usually a typo.
+
+    Use $${name} for a literal ${name}. That is how a script uses its own
+    shell variables when a name collides with a recipe variable and how it
+    avoids the warning for shell variables like $${HOME}. The escape works
+    in the variable values and in the steps:
+
+        [variable]
+        name = world
+        [step]
+        step = script """#!/bin/bash
+        name=local
+        echo "recipe: ${name} script: $${name}"
+        """
+
+    References can use operators like the shell to change the value. They
+    are evaluated by %[1]v in the variable values and in the steps so there
+    is no need to run bash just to change a string:
+
+        ${name:-default}    The default if the value is empty.
+        ${name:?message}    Fail with the message if the value is empty.
+        ${name^^}           The value in upper case.
+        ${name,,}           The value in lower case.
+        ${name#prefix}      The value without the prefix.
+        ${name%%suffix}      The value without the suffix.
+        ${name/old/new}     The value with the first old replaced by new.
+        ${name//old/new}    The value with all old replaced by new.
+        ${env:NAME}         The value of the NAME environment variable.
+
+    The arguments can reference other variables, like ${a:-${b}}. Unlike
+    the shell, the prefix, suffix and old arguments are plain text, not
+    patterns, and old cannot contain a slash. Here is an example:
+
+        [variable]
+        file = release.tar.gz
+        base = ${file%%.tar.gz}
+        out = ${env:BUILD_DIR:-/tmp/build}/${base}
+
+    A default value can be computed when the recipe runs from a source:
+
+        $(cmd)              The output of the bash command.
+        @file:path          The contents of the file, a leading ~ is the
+                            home directory.
+        @env:NAME           The value of the NAME environment variable, it
+                            is an error if it is not set.
+
+    The trailing new lines are removed like the shell does for $(cmd). The
+    source is computed once, after the references in it are resolved, and
+    only if the option was not specified on the command line. A dry run
+    does not run anything so the $(cmd) sources are shown as
+    <would run: cmd>, the file and environment sources are still read. A
+    source that fails is reported at the line where the variable was
+    declared. Use $${HOME} or $HOME for the shell
+    variables in a command. Here is an example:
+
+        [variable]
+        dir = .
+        version = $(git -C ${dir} describe --tags)
+        token = @file:~/.token
+        user = @env:USER
+
     Variable names appear as options on the command line. That means that
     if you define a variable named "foo", an option named --foo will be
     generated to set that variable. Here are some sample declarations of
@@ -123,17 +213,111 @@ RECIPES
         required =
         option = default
 
-    The step section defines the steps taken. It is very simple and does not
-    support looping or conditionals. That is because it is only meant to handle
-    high level operations that deal with running multiple scripts in order. For
-    lower level stuff that requires looping or conditionals, it makes more sense
-    to use a script. Note that you can embed an anonymous script if you don't
-    want to create an external one explicitly.
+    A variable can have a type. The value is checked before any step runs,
+    after the command line options and the variable references have been
+    applied. The type is declared after the variable with a .type
+    attribute:
+
+        int             An integer.
+        bool            true, false, yes, no, on, off, 1 or 0.
+        path            A file system path, it does not have to exist.
+        dir             An existing directory.
+        file            An existing file.
+        enum(a|b|c)     One of the values.
+        regex(RE)       A value that the regular expression RE matches
+                        completely.
+
+    Here is an example:
+
+        [variable]
+        jobs = 4
+        jobs.type = int
+        mode = debug
+        mode.type = enum(debug|release)
+        tag =
+        tag.type = "regex(v[0-9]+\\.[0-9]+)"
+
+    A variable can also have a description and a single letter short
+    option. They are declared with the .doc and .short attributes:
+
+        [variable]
+        jobs = 4
+        jobs.type = int
+        jobs.doc = The number of parallel jobs.
+        jobs.short = j
+
+    "%[1]v help <recipe>" generates an OPTIONS section from the variables
+    after the full description so that it cannot drift from the real
+    variables. It shows the short option, the description, the type and
+    the default value of each variable. Variables that do not have a .doc
+    attribute are flagged as undocumented. The short option -h is reserved.
+
+    The recipe options can be specified as --name value or --name=value.
+    A bool variable is set to true by --name and to false by --no-name, it
+    does not take a value unless the --name=value form is used. A variable
+    with a ".list = true" attribute accumulates the values when the option
+    is repeated, they are separated by spaces so a foreach step can loop
+    over them. The first value replaces the default value.
+
+        [variable]
+        target = all
+        target.list = true
+
+        $ %[1]v build --target lib --target=app
+
+    The arguments after -- are passed to the steps in the ${%[2]v_ARGS}
+    variable. They are quoted so that each one is a single argument of an
+    exec step or a command in a script.
+
+        step = exec make ${%[2]v_ARGS}
+
+        $ %[1]v build -- -j 8 "CFLAGS=-O2 -g"
+
+    A variable with a ".secret = true" attribute is for a password or a
+    token. Its value is shown as **** in everything that %[1]v writes: the
+    context, the step messages, the banners, the command output, the
+    ###export updates and the tee file. A value that contains the secret is
+    masked too. If the option is not specified and the variable does not
+    have a default value, %[1]v prompts for it without echo when stdin is a
+    terminal. The default value is redacted by --flatten and in the help.
+
+        [variable]
+        password =
+        password.secret = true
+        token = @file:~/.token
+        token.secret = true
+
+    The step section defines the steps taken. It is very simple and only
+    supports simple conditional, loop and parallel blocks. That is because
+    it is only meant to handle high level operations that deal with running
+    multiple scripts in order. For lower level stuff that requires more
+    complex logic, it makes more sense to use a script. Note that you can
+    embed an anonymous script if you don't want to create an external one
+    explicitly.
 
     Each entry in the step section is defined like this:
 
         step = <directive> <data>
 
+    The directive can be preceded by modifiers of the form <name>=<value>
+    that change how the step is run.
+
+        timeout=DURATION            Kill the command (and all of its child
+                                    processes) if the step runs longer than
+                                    DURATION. Example: timeout=10m.
+
+        retry=N                     Re-run a failed exec, exec-no-exit or
+                                    script step up to N times. The step only
+                                    fails if the last attempt fails.
+
+        backoff=DURATION            The delay before the first retry. It
+                                    doubles after each retry. The default is
+                                    no delay.
+
+    Here is an example:
+
+        step = timeout=30s retry=3 backoff=5s exec curl -s -O ${url}
+
     The directive tells %[1]v what to do. The following directives are
     available.
 
@@ -142,6 +326,10 @@ RECIPES
         export X=Y                  Define an env var for all subsequent steps.
 
         exec <cmd>                  Execute a command, stop if it fails.
+                                    It is split into words like the shell
+                                    does, 'single quoted' text is literal.
+                                    An unquoted ${name} can be several
+                                    words, "${name}" is one word.
 
         exec-no-exit <cmd>          Exexute a command, continue if it fails.
 
@@ -170,6 +358,102 @@ RECIPES
                                     specifying a line of the form:
                                         ###export <variable> = <value>
 
+    Steps can be run conditionally by wrapping them in a block that starts
+    with an if directive and ends with endif. An optional else directive
+    starts the block of steps that run when the condition is false. Blocks
+    can be nested.
+
+        if-var-set <var>            True if the variable has a value.
+
+        if-file-exists <path>       True if the file or directory exists.
+
+        if-env <name>[=<value>]     True if the environment variable is
+                                    defined (and has the value).
+
+        if-os <os> [<os> ...]       True if the OS is one of the listed ones.
+                                    Example: if-os linux darwin
+
+        else                        Start the else block.
+
+        endif                       End the block.
+
+    Here is an example:
+
+        step = if-file-exists ${dir}/Makefile
+        step = exec make -C ${dir}
+        step = else
+        step = info "no Makefile found in ${dir}"
+        step = endif
+
+    A block of steps can be repeated for each item in a list by wrapping
+    them in a foreach block. The items are separated by white space or
+    commas. The loop variable is defined as a recipe variable for each
+    iteration and is restored when the loop ends.
+
+        foreach <var> in <items>    Start the loop block.
+
+        endforeach                  End the loop block.
+
+    Here is an example:
+
+        [variable]
+        branches = "main dev"
+
+        [step]
+        step = foreach branch in ${branches}
+        step = exec git -C ${dir} checkout ${branch}
+        step = exec make -C ${dir}
+        step = endforeach
+
+    The exec, exec-no-exit and script steps in a parallel block run
+    concurrently. The output of each step is captured and written to the
+    log, prefixed by the step number, when the step finishes.
+
+        parallel [max=N] [policy=P] Start the parallel block.
+                                    max is the maximum number of steps that
+                                    run at the same time, the default is the
+                                    number of CPUs.
+                                    policy is fail-fast (the default) which
+                                    kills the running steps when one fails or
+                                    wait-all which runs all of the steps and
+                                    reports the failures at the end.
+
+        endparallel                 End the parallel block.
+
+    Here is an example:
+
+        step = parallel max=2
+        step = exec make -C ${dir}/lib1
+        step = exec make -C ${dir}/lib2
+        step = exec make -C ${dir}/lib3
+        step = endparallel
+
+    The finally section defines cleanup steps that always run after the
+    steps, even if a step failed, the recipe timed out or the user
+    interrupted it. It is like the step section and can also be named
+    [cleanup]. The ${CB_STATUS} variable tells the cleanup steps what
+    happened, it is one of:
+
+        passed         All of the steps passed.
+        failed         A step failed.
+        timeout        The recipe timed out or a step with a timeout=
+                       timed out.
+        interrupted    The user interrupted the recipe.
+
+    If a cleanup step fails the remaining cleanup steps are skipped. A
+    second interrupt stops the cleanup steps. The recipe fails if a step or
+    a cleanup step fails.
+
+    Here is an example:
+
+        [step]
+        step = exec docker run -d --name test-db postgres
+        step = exec make test
+
+        [finally]
+        step = info "tests ${CB_STATUS}, removing the database"
+        step = exec-no-exit docker rm -f test-db
+
     Here is an example recipe. It is named list-files.ini so you can refer to it
     as "list-files" on the command line.
 
@@ -233,6 +517,39 @@ RECIPES
     To list a different directory, do this:
         $ %[1]v list-files --dir /var/run
 
+RECIPE PATH
+    Recipes are found by searching the directories in the recipe path in
+    order, the first recipe with the name wins. This allows team, project
+    and personal recipes to coexist. The recipe path is:
+
+        1. The -r directories in the order that they were specified.
+        2. The project recipes directory, see below.
+        3. The directories in the %[2]v_RECIPE_PATH environment variable.
+           It is a colon separated list like PATH.
+        4. The default recipes directory, ../etc/%[1]v/recipes relative
+           to the %[1]v executable.
+
+    The project recipes directory is a .%[1]v/recipes or %[1]vrecipes
+    directory in the current directory or one of its parents, the closest
+    one is used. This works like git does for .git so a repository can
+    ship its own recipes and they can be run from any subdirectory of the
+    checkout.
+
+    The --list option shows the directory that each recipe came from.
+    Recipes that are hidden by a recipe with the same name in an earlier
+    directory are marked as shadowed.
+
+        $ export %[2]v_RECIPE_PATH=~/recipes:/opt/team/recipes
+        $ %[1]v -r ./recipes --list
+
+    Recipes can be organized into groups by putting them in subdirectories
+    of a recipe path directory. The subdirectory is the namespace of the
+    recipe. A recipe in build/linux/debug.ini is referenced as
+    build/linux/debug or build:linux:debug. Directories that start with a
+    dot are ignored. The --list option groups the recipes by namespace.
+
+        $ %[1]v build:debug --jobs 8
+
 ENVIRONMENT VARIABLES
     When a recipe is run there are environment variables that are made available
     to it by %[1]v. The list of environment variables is shown below.
@@ -254,22 +571,68 @@ CALLING OTHER RECIPES
 OPTIONS
     -h, --help         On-line help. Same as "%[1]v help".
 
+    --completion SHELL
+                       Write the completion script for a shell to stdout.
+                       The shells are bash, zsh and fish. The script
+                       completes the recipe names and, after a recipe
+                       name, the recipe options with their default values.
+                       It calls %[1]v to get them so they are always up
+                       to date.
+                           bash: source <(%[1]v --completion bash)
+                           zsh : source <(%[1]v --completion zsh)
+                           fish: %[1]v --completion fish | source
+
     -f FILE, --flatten FILE
                        Flatten a recipe into a file.
 
-    -l, --list         List the available recipes with a brief description.
+    --format FORMAT    The output format for --list and help <recipe>:
+                       text (the default), json or yaml. The json and yaml
+                       formats write the full recipe: the name, file,
+                       descriptions, variables with their default values
+                       and whether they are required, and the steps with
+                       their directive and location. They are meant for
+                       tools.
+
+    -l, --list         List the available recipes with a brief description
+                       and the directory that they came from.
+
+    -n, --dry-run      Load the recipe, set the variables and report each
+                       step (directive, data, working directory and script
+                       body) without running anything. Useful for auditing
+                       a recipe before running it. The steps in a foreach
+                       block are reported for each item.
 
     -q, --quiet        Run quietly. Only error messages are printed.
                        If -q and -v are not specified, only ERROR and WARNING
                        messages are printed.
 
+    --banner           Turn on the step banner in verbose mode. It is
+                       the default, use it to override banner = false in
+                       a configuration file.
+
     --no-banner        Turn off the step banner in verbose mode.
 
     -r DIR, --recipes DIR
-                       The path to the recipes directory.
+                       Add a directory to the front of the recipe path.
+                       It can be specified multiple times, the first one
+                       has the highest precedence.
 
     --run <cmd> <args> Run a command. Used for internal testing.
 
+    --search TERMS, search TERMS
+                       Search the recipe names, descriptions, variable
+                       names and steps for the terms and list the
+                       recipes that match, best match first. The matches
+                       are highlighted when the output is a terminal.
+                       Letters in order also match a recipe name so
+                       "dpstg" finds "deploy-staging".
+
+    -s FILE, --shell FILE
+                       Compile the recipe into a standalone bash script.
+                       The recipe variables become --name options of the
+                       script so it can be run on machines that do not
+                       have %[1]v installed.
+
     -t, --tee          Log all messages to a unique log file as well as stdout.
                        It saves having to create a unique file name for each run
                        using the command line tee tool.
@@ -277,14 +640,59 @@ OPTIONS
                        The output file name is
                            %[1]v-<YYYYMMDD>-<hhmmss>-<username>.log
 
+    --no-tee           Do not log to a file. Use it to override tee = true
+                       in a configuration file.
+
     -v, --verbose      Increase the level of verbosity.
                        It can be specified multiple times.
                            -v     --> print INFO and banner messages
                            -v -v  --> print INFO, banner and DEBUG messages
                        You always want to use -v when running recipes.
+                       The first -q or -v replaces the verbose setting
+                       of the configuration files.
 
     -V, --version      Print the program version and exit.
 
+CONFIGURATION FILES
+    The default options are read from the ~/.%[1]vrc user configuration
+    file and the project configuration file, the closest .%[1]vrc in the
+    current directory or one of its parents. The project settings override
+    the user settings and the command line options override both.
+
+    They use the recipe INI syntax with a single [options] section.
+
+        [options]
+        verbose = 2          # 0 (quiet) to 3, like -q, -v and -vv
+        tee = true           # like -t
+        banner = false       # like --no-banner
+        recipes = ~/recipes  # like -r, can be specified multiple times
+        scripts = ~/.%[1]v      # the anonymous script directory
+        logs = ~/logs        # the directory for the -t log files
+
+    Relative paths are relative to the directory of the configuration file.
+    The -r directories come before the project recipes directories which
+    come before the user recipes directories in the recipe path.
+
+EXIT CODES
+    The exit code tells you why %[1]v failed. They are stable so that they
+    can be used by CI scripts.
+
+        0        The recipe passed.
+        1        A step that does not run a command failed, like
+                 must-exist-file, or an internal error occurred.
+        64       Usage error, an invalid option was specified.
+        65       The recipe has a syntax error.
+        66       The recipe does not exist.
+        78       A required variable does not have a value, a value
+                 is not valid for the type of the variable or a
+                 ${name:?message} reference failed.
+        124      A step or the recipe timed out.
+        130      The recipe was interrupted.
+        other    A step failed, the exit code is the exit code of the
+                 command that failed.
+
+    The codes 64 to 78 are from sysexits.h, commands rarely use them.
+
 EXAMPLES
     $ # Example 1: Get help.
     $ %[1]v help
@@ -309,6 +717,21 @@ EXAMPLES
     $ # Example 7: Use a local recipe repository.
     $ %[1]v -v -r ~/my/recipes myrecipe1
 
+    $ # Example 8: Compile a recipe into a bash script.
+    $ %[1]v -s myrecipe.sh myrecipe
+
+    $ # Example 9: See what a recipe would do without running it.
+    $ %[1]v --dry-run <recipe> --foo bar
+
+    $ # Example 10: Enable shell completion for bash.
+    $ source <(%[1]v --completion bash)
+
+    $ # Example 11: Find the recipes that deploy to staging.
+    $ %[1]v search deploy staging
+
+    $ # Example 12: Write the recipe catalog for a tool.
+    $ %[1]v --list --format json > recipes.json
+
 `
 	// Get the built-in environment variables.
 	evs := []string{}
@@ -0,0 +1,333 @@
+// Recipe variable interpolation.
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// variableRef is a variable reference in a string. The forms are:
+//     ${name}             the value
+//     ${name:-default}    the default if the value is empty
+//     ${name:?message}    an error with the message if the value is empty
+//     ${name^^}           the value in upper case
+//     ${name,,}           the value in lower case
+//     ${name#prefix}      the value without the prefix, ## is the same
+//     ${name%suffix}      the value without the suffix, %% is the same
+//     ${name/old/new}     the value with the first old replaced by new
+//     ${name//old/new}    the value with all old replaced by new
+//     ${env:NAME}         the value of an environment variable
+// The operator arguments can contain references, like ${a:-${b}}. Unlike
+// bash, the prefix, suffix and old arguments are text, not patterns.
+// A reference that starts with $$ is escaped, $${name} is the literal
+// text ${name}.
+type variableRef struct {
+	start int    // position of the $
+	end   int    // position after the }
+	name  string // the variable name or env:NAME
+	op    string // the operator, empty for a plain reference
+	arg   string // the operator argument
+	arg2  string // the replacement for / and //
+}
+
+// variableNameRegexp matches the name at the start of a reference.
+var variableNameRegexp = regexp.MustCompile(`^(?:env:)?[a-zA-Z_][a-zA-Z_\-0-9]*`)
+
+// env reports whether the reference is an environment variable.
+func (r variableRef) env() bool {
+	return strings.HasPrefix(r.name, "env:")
+}
+
+// scanVariableRefs finds the variable references in a string. Text that
+// looks like a reference but is not one of the forms, like ${#x}, is not
+// a reference and neither is an escaped reference.
+func scanVariableRefs(s string) (refs []variableRef) {
+	for p := 0; p < len(s); {
+		i := strings.Index(s[p:], "${")
+		if i < 0 {
+			break
+		}
+		start := p + i
+		p = start + 2
+		if start > 0 && s[start-1] == '$' {
+			continue // escaped
+		}
+
+		// Find the closing brace, the argument can contain references.
+		depth := 1
+		end := -1
+		for j := start + 2; j < len(s) && end < 0; j++ {
+			switch {
+			case s[j] == '$' && j+1 < len(s) && s[j+1] == '{':
+				depth++
+				j++
+			case s[j] == '}':
+				depth--
+				if depth == 0 {
+					end = j
+				}
+			}
+		}
+		if end < 0 {
+			break
+		}
+		body := s[start+2 : end]
+		name := variableNameRegexp.FindString(body)
+		if name == "" {
+			continue
+		}
+		r := variableRef{start: start, end: end + 1, name: name}
+		rest := body[len(name):]
+		switch {
+		case rest == "":
+		case rest == "^^", rest == ",,":
+			r.op = rest
+		case strings.HasPrefix(rest, ":-"), strings.HasPrefix(rest, ":?"):
+			r.op, r.arg = rest[:2], rest[2:]
+		case strings.HasPrefix(rest, "//"), strings.HasPrefix(rest, "/"):
+			r.op = "/"
+			if strings.HasPrefix(rest, "//") {
+				r.op = "//"
+			}
+			flds := strings.SplitN(rest[len(r.op):], "/", 2)
+			r.arg = flds[0]
+			if len(flds) > 1 {
+				r.arg2 = flds[1]
+			}
+		case strings.HasPrefix(rest, "##"), strings.HasPrefix(rest, "%%"):
+			r.op, r.arg = rest[:2], rest[2:]
+		case rest[0] == '#', rest[0] == '%':
+			r.op, r.arg = rest[:1], rest[1:]
+		default:
+			continue
+		}
+		refs = append(refs, r)
+		p = r.end
+	}
+	return
+}
+
+// interpolateString replaces the variable references in a string with
+// their values in a single pass, the values are not interpolated again.
+// References to names that are not variables are left as they are
+// because they could be shell variables in a script. The escaped
+// references are replaced by the literal text.
+func interpolateString(s string, vars map[string]string) (string, error) {
+	if strings.Contains(s, "${") == false {
+		return s, nil
+	}
+	var buf strings.Builder
+	p := 0
+	for _, r := range scanVariableRefs(s) {
+		val, ok, err := evalVariableRef(r, vars)
+		if err != nil {
+			return s, err
+		}
+		if ok == false {
+			continue // not a variable, keep the text
+		}
+		buf.WriteString(unescapeVariableRefs(s[p:r.start]))
+		buf.WriteString(val)
+		p = r.end
+	}
+	buf.WriteString(unescapeVariableRefs(s[p:]))
+	return buf.String(), nil
+}
+
+// unescapeVariableRefs replaces the escaped references, $${name}, in text
+// that is not a reference by the literal text, ${name}.
+func unescapeVariableRefs(s string) string {
+	return strings.Replace(s, "$${", "${", -1)
+}
+
+// unresolvedVariableRefs returns the names of the references in a string
+// that are not variables. They are left as they are by interpolateString.
+func unresolvedVariableRefs(s string, vars map[string]string) (names []string) {
+	for _, r := range scanVariableRefs(s) {
+		if _, ok := vars[r.name]; ok == false && r.env() == false {
+			names = append(names, r.name)
+		}
+	}
+	return
+}
+
+// evalVariableRef evaluates a reference. It returns false if the name is
+// not a variable.
+func evalVariableRef(r variableRef, vars map[string]string) (val string, ok bool, err error) {
+	if r.env() {
+		val = os.Getenv(r.name[4:])
+	} else if val, ok = vars[r.name]; ok == false {
+		return
+	}
+	ok = true
+	arg := func(a string) string {
+		if err == nil {
+			a, err = interpolateString(a, vars)
+		}
+		return a
+	}
+	switch r.op {
+	case ":-":
+		if val == "" {
+			val = arg(r.arg)
+		}
+	case ":?":
+		if val == "" {
+			msg := arg(r.arg)
+			if msg == "" {
+				msg = "no value"
+			}
+			if err == nil {
+				err = fmt.Errorf("%v: %v", r.name, msg)
+			}
+		}
+	case "^^":
+		val = strings.ToUpper(val)
+	case ",,":
+		val = strings.ToLower(val)
+	case "#", "##":
+		val = strings.TrimPrefix(val, arg(r.arg))
+	case "%", "%%":
+		val = strings.TrimSuffix(val, arg(r.arg))
+	case "/", "//":
+		n := 1
+		if r.op == "//" {
+			n = -1
+		}
+		if old := arg(r.arg); old != "" {
+			val = strings.Replace(val, old, arg(r.arg2), n)
+		}
+	}
+	return
+}
+
+// variableRefNames returns the names of the recipe variables that a
+// string references, including the references in operator arguments.
+// Environment variables are not included.
+func variableRefNames(s string) (names []string) {
+	for _, r := range scanVariableRefs(s) {
+		if r.env() == false {
+			names = append(names, r.name)
+		}
+		names = append(names, variableRefNames(r.arg)...)
+		names = append(names, variableRefNames(r.arg2)...)
+	}
+	return
+}
+
+// interpolateRecipeVariables resolves the references in the values of
+// the declared variables. A variable is resolved after the variables
+// that it references so the result does not depend on the order of the
+// declarations. The built-in variables are not interpolated, they come
+// from the environment.
+//
+// A default value that has a source, like $(cmd), is computed after it
+// is interpolated so the source can reference other variables. It is
+// only computed once and only if the variable was not set on the
+// command line. A dry run does not run the $(cmd) sources, the value is
+// a placeholder and the variable, and the variables that reference it,
+// are returned in pending.
+//
+// A reference cycle or a reference to a variable that does not exist is
+// reported at the line where the variable was declared, so is a source
+// that fails, unless the value came from the command line.
+func interpolateRecipeVariables(recipe *RecipeInfo, set map[string]bool, dryrun bool) (pending map[string]bool, err error) {
+	order, err := orderRecipeVariables(*recipe, set)
+	if err != nil {
+		return
+	}
+	pending = map[string]bool{}
+	for _, name := range order {
+		for _, ref := range variableRefNames(recipe.Variables[name]) {
+			if pending[ref] {
+				pending[name] = true // it contains the placeholder
+			}
+		}
+		val, e := interpolateString(recipe.Variables[name], recipe.Variables)
+		if e == nil && recipe.Decls[name].Source != "" && set[name] == false {
+			if kind, arg := parseVariableSource(val); dryrun && kind == "cmd" {
+				val = fmt.Sprintf("<would run: %v>", arg)
+				pending[name] = true
+			} else {
+				val, e = evalVariableSource(val)
+			}
+		}
+		if e != nil {
+			ve := &VariableRefError{Line: recipe.Decls[name].Line, Name: name, Err: e}
+			if set[name] {
+				ve.Line = LineInfo{} // the option value is wrong, not the declaration
+			}
+			err = ve
+			return
+		}
+		recipe.Variables[name] = val
+	}
+	return
+}
+
+// orderRecipeVariables sorts the declared variables so that each variable
+// comes after the variables that its value references. Variables that do
+// not depend on each other are sorted by name so the order is stable.
+// The errors for the values in set, the ones that were specified on the
+// command line, are reported for the option instead of the declaration.
+func orderRecipeVariables(recipe RecipeInfo, set map[string]bool) (order []string, err error) {
+	names := []string{}
+	for k := range recipe.Decls {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	path := []string{} // the variables being visited, for the cycle report
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			p := 0
+			for path[p] != name {
+				p++
+			}
+			cycle := append(append([]string{}, path[p:]...), name)
+			for _, c := range cycle {
+				if set[c] {
+					return &UsageError{Msg: fmt.Sprintf("invalid value for --%v: variable reference cycle: %v", c, strings.Join(cycle, " -> "))}
+				}
+			}
+			return newParseError(recipe.Decls[name].Line, "variable reference cycle: %v", strings.Join(cycle, " -> "))
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, ref := range variableRefNames(recipe.Variables[name]) {
+			if _, ok := recipe.Variables[ref]; ok == false {
+				if set[name] {
+					return &UsageError{Msg: fmt.Sprintf("invalid value for --%v: reference to undefined variable '%v', use '$${%v}' for a literal '${%v}'", name, ref, ref, ref)}
+				}
+				return newParseError(recipe.Decls[name].Line, "variable '%v' references undefined variable '%v'", name, ref)
+			}
+			if _, ok := recipe.Decls[ref]; ok {
+				if err := visit(ref); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err = visit(name); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInterpolateString(t *testing.T) {
+	vars := map[string]string{"a": "x", "b": "${a}y", "path": "/usr/local/bin", "empty": ""}
+	tests := []struct {
+		text string
+		want string
+		err  string // part of the error message, empty if there is no error
+	}{
+		{"${a}", "x", ""},
+		{"[${a}] [${a}]", "[x] [x]", ""},
+		{"${b}", "${a}y", ""}, // the values are not interpolated again
+		{"$${a}", "${a}", ""},
+		{"$${a} ${a}", "${a} x", ""},
+		{"$a ${nope}", "$a ${nope}", ""},
+		{"${empty:-${a}}", "x", ""},
+		{"${path##/usr/local/}", "bin", ""},
+		{"${a^^}", "X", ""},
+		{"${empty:?is required}", "", "empty: is required"},
+		{"${empty:?}", "", "empty: no value"},
+	}
+	for _, tt := range tests {
+		got, err := interpolateString(tt.text, vars)
+		switch {
+		case tt.err != "" && (err == nil || strings.Contains(err.Error(), tt.err) == false):
+			t.Errorf("interpolateString(%q) error = %v, want %q", tt.text, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("interpolateString(%q) unexpected error: %v", tt.text, err)
+		case tt.err == "" && got != tt.want:
+			t.Errorf("interpolateString(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestInterpolateRecipeVariables(t *testing.T) {
+	tests := []struct {
+		name string
+		vars string   // the [variable] section
+		args []string // the recipe options
+		want map[string]string
+		err  string // part of the error message, empty if there is no error
+		code int    // the exit code for the error
+	}{
+		{
+			name: "order",
+			vars: "c = ${b}/c\nb = ${a}/b\na = a\n",
+			want: map[string]string{"a": "a", "b": "a/b", "c": "a/b/c"},
+		},
+		{
+			name: "option",
+			vars: "dir = /tmp\nfile = ${dir}/x\n",
+			args: []string{"--dir", "/var"},
+			want: map[string]string{"dir": "/var", "file": "/var/x"},
+		},
+		{
+			name: "option reference",
+			vars: "dir = /tmp\nfile = x\n",
+			args: []string{"--file", "${dir}/y"},
+			want: map[string]string{"dir": "/tmp", "file": "/tmp/y"},
+		},
+		{
+			name: "escape",
+			vars: "a = x\nb = $${a} ${a}\n",
+			want: map[string]string{"a": "x", "b": "${a} x"},
+		},
+		{
+			name: "escape option",
+			vars: "a = x\n",
+			args: []string{"--a", "$${nope}"},
+			want: map[string]string{"a": "${nope}"},
+		},
+		{
+			name: "cycle",
+			vars: "a = ${b}\nb = ${c}\nc = ${a}\n",
+			err:  "variable reference cycle: a -> b -> c -> a at line",
+			code: exitParse,
+		},
+		{
+			name: "self",
+			vars: "a = ${a}x\n",
+			err:  "variable reference cycle: a -> a at line",
+			code: exitParse,
+		},
+		{
+			name: "cycle option",
+			vars: "a = x\nb = ${a}\n",
+			args: []string{"--a", "${b}"},
+			err:  "invalid value for --a: variable reference cycle: a -> b -> a",
+			code: exitUsage,
+		},
+		{
+			name: "undefined",
+			vars: "a = ${nope}\n",
+			err:  "variable 'a' references undefined variable 'nope' at line",
+			code: exitParse,
+		},
+		{
+			name: "undefined option",
+			vars: "a = x\n",
+			args: []string{"--a", "${nope}"},
+			err:  "invalid value for --a: reference to undefined variable 'nope'",
+			code: exitUsage,
+		},
+		{
+			name: "required option",
+			vars: "a = x\nb = y\n",
+			args: []string{"--b", "${a:-}${a:?}"},
+			want: map[string]string{"a": "x", "b": "xx"},
+		},
+	}
+	for _, tt := range tests {
+		recipe := testLoadRecipe(t, "[description]\nbrief = v\nfull = v\n\n[variable]\n"+tt.vars+"\n[step]\nstep = info ok\n")
+		_, err := testRunRecipe(t, recipe, tt.args...)
+		if tt.err != "" {
+			if err == nil || strings.Contains(err.Error(), tt.err) == false {
+				t.Errorf("%v: error = %v, want %q", tt.name, err, tt.err)
+			} else if code := exitCode(err); code != tt.code {
+				t.Errorf("%v: exit code %v, want %v", tt.name, code, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+			continue
+		}
+		for k, v := range tt.want {
+			if recipe.Variables[k] != v {
+				t.Errorf("%v: %v = %q, want %q", tt.name, k, recipe.Variables[k], v)
+			}
+		}
+	}
+}
@@ -50,6 +50,12 @@ func main() {
 		b := path.Base(os.Args[0])
 		u, _ := user.Current()
 		tee = fmt.Sprintf("%v-%v-%v.log", b, t, u.Username)
+		if opts.LogDir != "" {
+			if err := os.MkdirAll(opts.LogDir, 0755); err != nil {
+				Log.Err("unable to create log directory: %v - %v", opts.LogDir, err)
+			}
+			tee = path.Join(opts.LogDir, tee)
+		}
 		Log.Info("tee file : %v", tee)
 		fp, err := os.Create(tee)
 		if err != nil {
@@ -61,8 +67,15 @@ func main() {
 
 	// Display the run-time context.
 	MakeContext(tee)
-	if opts.RecipeDir != "" {
-		Context.RecipeDir = opts.RecipeDir
+	if opts.ScriptDir != "" {
+		Context.ScriptDir = opts.ScriptDir
+	}
+	Context.SetRecipePath(opts.RecipeDirs)
+	for _, fn := range opts.ConfigFiles {
+		Log.Info("config file: %v", fn)
+	}
+	if opts.Action == actionRecipe {
+		addOptionSecrets(opts)
 	}
 	Context.PrintContext()
 
@@ -80,19 +93,30 @@ func main() {
 	setenv("pid", strconv.Itoa(Context.UserPID))
 	setenv("pwd", Context.Pwd)
 	setenv("recipes", Context.RecipeDir)
+	setenv("recipe_path", strings.Join(Context.RecipePath, ":"))
 	setenv("scripts", Context.ScriptDir)
 	setenv("timestamp", Context.TimeStamp)
 	setenv("username", Context.UserName)
 	setenv("version", Context.MakeVersion)
 
 	// Perform the specified action.
+	// The errors are reported here, nothing below this exits.
+	var err error
 	switch opts.Action {
 	case actionHelp:
-		help(opts)
+		err = help(opts)
 	case actionList:
-		listAllRecipes()
+		err = listAllRecipes(opts)
+	case actionSearch:
+		err = searchRecipes(opts.ExtraArgs)
+	case actionCompletion:
+		err = completion(opts.Shell)
+	case actionCompleteRecipes:
+		err = completeRecipes()
+	case actionCompleteOptions:
+		err = completeOptions(opts.Recipe)
 	case actionRecipe:
-		runRecipe(opts)
+		err = runRecipe(opts)
 	case actionRun:
 		RunOpt(opts.ExtraArgs)
 	case actionRunSilent:
@@ -100,6 +124,10 @@ func main() {
 	default:
 		break
 	}
+	if err != nil {
+		Log.ErrNoExit("%v", err)
+		os.Exit(exitCode(err))
+	}
 }
 
 // init the logger
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 )
 
 // CliOptionsType defines the type of action.
@@ -16,6 +17,10 @@ const (
 	actionRun
 	actionRunSilent
 	actionList
+	actionCompletion
+	actionCompleteRecipes
+	actionCompleteOptions
+	actionSearch
 )
 
 // CliOptions are the command line options.
@@ -24,12 +29,19 @@ type CliOptions struct {
 	Dryrun      bool
 	HelpArg     string
 	Flatten     string
+	Format      string // text, json or yaml for --list and help
 	Tee         bool
 	ShellScript string
 	Recipe      string
-	RecipeDir   string
+	Shell       string // for --completion
+	RecipeDirs  []string
 	ExtraArgs   []string
 
+	// Set by the configuration files.
+	ConfigFiles []string
+	ScriptDir   string
+	LogDir      string
+
 	// Special case to allow users to disable banners
 	// in verbose mode.
 	Banner bool
@@ -47,10 +59,17 @@ type CliOptions struct {
 }
 
 // NewCliOptions gets the command line options and figures out the
-// action to take.
+// action to take. The defaults come from the configuration files.
 func NewCliOptions() (opts CliOptions) {
 	opts.Verbose = 1   // WARNING, ERROR
 	opts.Banner = true // print the banner of INFO messages are enabled
+	opts.Format = "text"
+	dirs, err := readConfig(&opts)
+	if err != nil {
+		Log.ErrNoExit("%v", err)
+		os.Exit(exitCode(err))
+	}
+	verbose := false // -q or -v was specified, they replace the configured verbosity
 	for i := 1; i < len(os.Args); i++ {
 		arg := os.Args[i]
 		switch arg {
@@ -59,28 +78,62 @@ func NewCliOptions() (opts CliOptions) {
 			// can't do it here because the optional
 			// argument is a recipe that requires searching
 			// to find.
+			// An option is not a recipe so "help --format json" is
+			// reported as an error below instead of as a missing
+			// recipe.
 			opts.Action = actionHelp // overrides all other actions
-			i++
-			if i < len(os.Args) {
+			if i+1 < len(os.Args) && strings.HasPrefix(os.Args[i+1], "-") == false {
+				i++
 				opts.HelpArg = os.Args[i]
 			}
+		case "--search", "search":
+			// the remaining arguments are the search terms
+			opts.Action = actionSearch // overrides all other actions
+			opts.ExtraArgs = os.Args[i+1:]
+			i = len(os.Args)
+		case "--completion":
+			// generate a shell completion script
+			opts.Action = actionCompletion
+			opts.Shell = cliGetNextArg(&i)
+		case "--complete-recipes":
+			// callback for the completion scripts
+			opts.Action = actionCompleteRecipes
+		case "--complete-options":
+			// callback for the completion scripts
+			opts.Action = actionCompleteOptions
+			opts.Recipe = cliGetNextArg(&i)
 		case "-f", "--flatten":
 			// flatten means flatten a recipe.
 			// It is only invoked for a recipe.
 			opts.Flatten = cliGetNextArg(&i)
+		case "--format":
+			// the output format for --list and help
+			opts.Format = cliGetNextArg(&i)
+			switch opts.Format {
+			case "text", "json", "yaml":
+			default:
+				cliUsageError("unsupported format '%v', expected text, json or yaml", opts.Format)
+			}
+		case "-n", "--dry-run", "--dryrun":
+			// dry run means show the recipe steps without running them.
+			opts.Dryrun = true
 		case "-l", "--list":
 			// list means list all of the recipes along with their brief descriptions
 			if opts.Action == actionUnknown {
 				opts.Action = actionList // do not override other actions
 			}
+		case "--banner":
+			opts.Banner = true // overrides banner = false in a config file
 		case "--no-banner":
 			opts.Banner = false // default is to print the banner.
 		case "-r", "--recipes":
+			// can be specified multiple times, the first one has the
+			// highest precedence
 			d := cliGetNextArg(&i)
 			if IsDir(d) == false {
-				Log.Err("not a valid directory: %v", d)
+				cliUsageError("not a valid directory: %v", d)
 			}
-			opts.RecipeDir = d
+			opts.RecipeDirs = append(opts.RecipeDirs, d)
 		case "--run":
 			if opts.Action == actionUnknown {
 				opts.Action = actionRun // do not override other actions
@@ -89,7 +142,7 @@ func NewCliOptions() (opts CliOptions) {
 			if i < len(os.Args) {
 				opts.ExtraArgs = os.Args[i:]
 			} else {
-				Log.Err("missing arguments for --run")
+				cliUsageError("missing arguments for --run")
 			}
 			i = len(os.Args)
 		case "--run-silent":
@@ -100,7 +153,7 @@ func NewCliOptions() (opts CliOptions) {
 			if i < len(os.Args) {
 				opts.ExtraArgs = os.Args[i:]
 			} else {
-				Log.Err("missing arguments for --run")
+				cliUsageError("missing arguments for --run")
 			}
 			i = len(os.Args)
 		case "-s", "--shell":
@@ -109,19 +162,29 @@ func NewCliOptions() (opts CliOptions) {
 		case "-t", "--tee":
 			// tee the output to a unique file name
 			opts.Tee = true
+		case "--no-tee":
+			opts.Tee = false // overrides tee = true in a config file
 		case "-q", "--quiet":
 			opts.Verbose = 0 // default is 1
-		case "-v", "--verbose":
+			verbose = true
+		case "-v", "--verbose", "-vv":
+			// The first one starts from the default, not from the
+			// verbosity in a config file.
+			if verbose == false {
+				opts.Verbose = 1
+				verbose = true
+			}
 			opts.Verbose++
-		case "-vv": // shorthand for -v -v
-			opts.Verbose += 2
+			if arg == "-vv" { // shorthand for -v -v
+				opts.Verbose++
+			}
 		case "-V", "--version":
 			base := path.Base(os.Args[0])
 			fmt.Printf("%v - v%v\n", base, Version)
 			os.Exit(0)
 		default:
 			if arg[0] == '-' {
-				Log.Err("unrecognized option '%v', try -h for more information", arg)
+				cliUsageError("unrecognized option '%v', try -h for more information", arg)
 			}
 			if opts.Action == actionUnknown {
 				opts.Action = actionRecipe // do not override other actions
@@ -134,6 +197,16 @@ func NewCliOptions() (opts CliOptions) {
 			i = len(os.Args)
 		}
 	}
+
+	// The command line recipe directories have the highest precedence.
+	opts.RecipeDirs = append(opts.RecipeDirs, dirs...)
+
+	// The completion callbacks must only write the completions.
+	switch opts.Action {
+	case actionCompletion, actionCompleteRecipes, actionCompleteOptions:
+		opts.Verbose = 0
+		opts.Tee = false
+	}
 	return
 }
 
@@ -142,7 +215,14 @@ func cliGetNextArg(i *int) (arg string) {
 	opt := os.Args[*i]
 	*i++
 	if *i >= len(os.Args) {
-		Log.Err("missing argument for option %v", opt)
+		cliUsageError("missing argument for option %v", opt)
 	}
 	return os.Args[*i]
 }
+
+// cliUsageError reports a command line usage error and exits with the
+// usage exit code.
+func cliUsageError(f string, a ...interface{}) {
+	Log.ErrNoExit(f, a...)
+	os.Exit(exitUsage)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCliOptionsConfig(t *testing.T) {
+	dir := t.TempDir()
+	rc := "[options]\nverbose = 3\ntee = true\nbanner = false\n"
+	if err := os.WriteFile(filepath.Join(dir, ".cbrc"), []byte(rc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", dir)
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	tests := []struct {
+		args    []string
+		verbose int
+		tee     bool
+		banner  bool
+	}{
+		{[]string{}, 3, true, false},
+		{[]string{"-v"}, 2, true, false},
+		{[]string{"-v", "-v"}, 3, true, false},
+		{[]string{"-vv"}, 3, true, false},
+		{[]string{"-q"}, 0, true, false},
+		{[]string{"-q", "-v"}, 1, true, false},
+		{[]string{"--no-tee", "--banner"}, 3, false, true},
+	}
+	for _, tt := range tests {
+		os.Args = append([]string{"cb"}, tt.args...)
+		opts := NewCliOptions()
+		if opts.Verbose != tt.verbose || opts.Tee != tt.tee || opts.Banner != tt.banner {
+			t.Errorf("%q: verbose=%v tee=%v banner=%v, want verbose=%v tee=%v banner=%v",
+				tt.args, opts.Verbose, opts.Tee, opts.Banner, tt.verbose, tt.tee, tt.banner)
+		}
+	}
+}
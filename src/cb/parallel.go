@@ -0,0 +1,243 @@
+// Run the steps in a parallel block concurrently.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlinoff/go/run"
+)
+
+// parallelJob is a step that runs in a parallel block.
+type parallelJob struct {
+	stepi   int // step number, for reporting
+	step    RecipeStep
+	cmd     string // command to run
+	script  string // anonymous script file, if any
+	buf     bytes.Buffer
+	err     error
+	ran     bool
+	elapsed time.Duration
+}
+
+// runRecipeParallel runs the steps in the parallel block that starts at
+// index start concurrently. Each step captures its output in its own buffer
+// which is written to the log, prefixed by the step number, when the step
+// finishes so that the output of different steps is never interleaved.
+//
+// The options are:
+//     max=N               Run at most N steps at a time. The default is the
+//                         number of CPUs.
+//     policy=fail-fast    Kill the running steps and do not start any new
+//                         ones when a step fails. This is the default.
+//     policy=wait-all     Run all of the steps and report the failures at the
+//                         end.
+//
+// A timeout on the parallel step applies to the whole block, a timeout on
+// a step in the block applies to that step.
+func runRecipeParallel(rctx context.Context, recipe *RecipeInfo, steps []RecipeStep, start int) error {
+	pstep := steps[start]
+	data, err := runRecipeSubstituteVariables(pstep, *recipe)
+	if err != nil {
+		return &VariableRefError{Line: pstep.Line, Step: start + 1, Err: err}
+	}
+	pstep.Data = data
+	max, failFast, err := parseParallelOptions(pstep.Data)
+	if err != nil {
+		return newStepError(pstep, start+1, "%v", err)
+	}
+
+	// Prepare the jobs in this goroutine so that any errors are reported
+	// before anything starts running.
+	jobs := []*parallelJob{}
+	for i := start + 1; i < pstep.Match; i++ {
+		job := &parallelJob{stepi: i + 1, step: steps[i]}
+		job.step.Data, err = runRecipeSubstituteVariables(job.step, *recipe)
+		if err != nil {
+			return &VariableRefError{Line: job.step.Line, Step: job.stepi, Err: err}
+		}
+		if job.step.Directive == stepScript {
+			job.script, err = runRecipeCreateScript(job.step, job.stepi)
+			if err != nil {
+				for _, j := range jobs {
+					if j.script != "" {
+						os.Remove(j.script)
+					}
+				}
+				return newStepError(job.step, job.stepi, "%v", err)
+			}
+			job.cmd = job.script
+		} else {
+			job.cmd = job.step.Data
+		}
+		jobs = append(jobs, job)
+	}
+	Log.Info("parallel.start = %v %v steps, max %v, fail-fast %v", start+1, len(jobs), max, failFast)
+
+	ctx, cancel := runRecipeStepContext(rctx, pstep)
+	defer cancel()
+	sem := make(chan bool, max)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // serializes the output
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *parallelJob) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return // a step failed, don't start
+			}
+			s := time.Now()
+			job.ran = true
+			runRecipeParallelJob(ctx, job)
+			job.elapsed = time.Since(s)
+
+			mu.Lock()
+			defer mu.Unlock()
+			runRecipeParallelFlush(job)
+			if job.err != nil && failFast && job.step.Directive != stepExecNoExit {
+				cancel()
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	// Report the results in step order.
+	// The exit code of the first failed step is the exit code of the block.
+	nf := 0
+	var ferr error
+	for _, job := range jobs {
+		if job.script != "" {
+			Log.Info("deleting anonymous script file: %v", job.script)
+			os.Remove(job.script)
+		}
+		switch {
+		case job.ran == false:
+			Log.Info("step.skip = %v not started because a parallel step failed", job.stepi)
+			continue
+		case job.err == nil:
+			Log.Info("step.status = %v passed", job.stepi)
+		case rctx.Err() != nil:
+			Log.Warn("step.status = %v killed - %v", job.stepi, rctx.Err())
+		case job.err == context.Canceled:
+			Log.Warn("step.status = %v killed because a parallel step failed", job.stepi)
+		case job.err == context.DeadlineExceeded && ctx.Err() == context.DeadlineExceeded:
+			nf++
+			ferr = firstError(ferr, job.err)
+			Log.ErrNoExit("step.status = %v killed because the parallel block timed out after %.03f seconds (timeout=%v)", job.stepi, job.elapsed.Seconds(), pstep.Timeout)
+		case job.err == context.DeadlineExceeded && job.step.Directive != stepExecNoExit:
+			nf++
+			ferr = firstError(ferr, job.err)
+			Log.ErrNoExit("step.status = %v timed out after %.03f seconds (timeout=%v)", job.stepi, job.elapsed.Seconds(), job.step.Timeout)
+		case job.step.Directive == stepExecNoExit:
+			Log.Warn("step.status = %v failed (%v) - %v", job.stepi, run.GetExitCode(job.err), job.err)
+		default:
+			nf++
+			ferr = firstError(ferr, job.err)
+			Log.ErrNoExit("step.status = %v failed (%v) - %v", job.stepi, run.GetExitCode(job.err), job.err)
+		}
+		runRecipeResetVariablesFromOutput(job.buf, recipe)
+		Log.Info("step.end = %v %.03f", job.stepi, job.elapsed.Seconds())
+	}
+	if rctx.Err() != nil {
+		return runRecipeContextError(rctx, *recipe, start+1)
+	}
+	if nf > 0 {
+		serr := newStepError(pstep, start+1, "%v parallel step(s) failed in the block", nf)
+		serr.Err = ferr
+		if ferr != context.DeadlineExceeded {
+			serr.Code = run.GetExitCode(ferr)
+		}
+		return serr
+	}
+	return nil
+}
+
+// firstError returns the first error that is not nil.
+func firstError(first error, err error) error {
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// runRecipeParallelJob runs the command for a job, retrying it if
+// necessary. It does not log anything, the retry messages are written to
+// the job output.
+func runRecipeParallelJob(ctx context.Context, job *parallelJob) {
+	delay := job.step.Backoff
+	for attempt := 1; ; attempt++ {
+		jctx, jcancel := runRecipeStepContext(ctx, job.step)
+		job.err = RunCmdContext(jctx, []io.Writer{&job.buf}, "%v", job.cmd)
+		jcancel()
+		if job.err == nil || ctx.Err() != nil || attempt > job.step.Retry {
+			return
+		}
+		fmt.Fprintf(&job.buf, "attempt %v of %v failed (%v) - %v, retrying in %v\n", attempt, job.step.Retry+1, run.GetExitCode(job.err), job.err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+}
+
+// runRecipeParallelFlush writes the output of a job to the log.
+// The caller must serialize the calls.
+func runRecipeParallelFlush(job *parallelJob) {
+	out := strings.TrimRight(job.buf.String(), "\n")
+	if len(out) == 0 {
+		return
+	}
+	for _, line := range strings.Split(out, "\n") {
+		Log.Printf("[step %v] %v\n", job.stepi, line)
+	}
+}
+
+// parseParallelOptions parses the options for the parallel directive.
+func parseParallelOptions(data string) (max int, failFast bool, err error) {
+	max = Context.NumCpus
+	failFast = true
+	for _, opt := range strings.Fields(data) {
+		flds := strings.SplitN(opt, "=", 2)
+		if len(flds) != 2 {
+			err = fmt.Errorf("invalid parallel option '%v', expected max=N or policy=fail-fast|wait-all", opt)
+			return
+		}
+		switch flds[0] {
+		case "max":
+			n, e := strconv.Atoi(flds[1])
+			if e != nil || n < 1 {
+				err = fmt.Errorf("invalid parallel option '%v', max must be a positive integer", opt)
+				return
+			}
+			max = n
+		case "policy":
+			switch flds[1] {
+			case "fail-fast":
+				failFast = true
+			case "wait-all":
+				failFast = false
+			default:
+				err = fmt.Errorf("invalid parallel option '%v', policy must be fail-fast or wait-all", opt)
+				return
+			}
+		default:
+			err = fmt.Errorf("invalid parallel option '%v', expected max=N or policy=fail-fast|wait-all", opt)
+			return
+		}
+	}
+	if max < 1 {
+		max = 1
+	}
+	return
+}
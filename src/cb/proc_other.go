@@ -0,0 +1,20 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+// Process group support for systems that do not have them.
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills the command.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
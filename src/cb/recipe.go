@@ -6,18 +6,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/jlinoff/go/run"
 )
 
 // FileInfo is the file information associated with each line.
@@ -49,14 +53,36 @@ const (
 	stepMustNotExistDir
 	stepMustNotExistFile
 	stepScript
+	stepIfVarSet
+	stepIfFileExists
+	stepIfEnv
+	stepIfOs
+	stepElse
+	stepEndif
+	stepForeach
+	stepEndforeach
+	stepParallel
+	stepEndparallel
 )
 
 // RecipeStep components.
+// Timeout is the maximum time that the step is allowed to run, zero means
+// that there is no limit. It is set by the timeout=DURATION modifier.
+// Retry is the number of times that a failed command is re-run and Backoff
+// is the delay before the first retry, it doubles for each subsequent one.
+// Match is the index of the matching step for block directives. For an if
+// it is the index of the else or endif, for an else it is the index of
+// the endif and for an endif it is the index of the if. For a foreach or
+// parallel it is the index of the endforeach or endparallel and vice versa.
 type RecipeStep struct {
 	Directive       RecipeStepType
 	DirectiveString string
 	Data            string
 	Line            LineInfo
+	Match           int
+	Timeout         time.Duration
+	Retry           int
+	Backoff         time.Duration
 }
 
 // RecipeInfo stores the information for a recipe.
@@ -65,67 +91,171 @@ type RecipeInfo struct {
 	Name      string
 	Full      string
 	Brief     string
+	Timeout   time.Duration
 	Variables map[string]string
+	Decls     map[string]RecipeVariable // declarations of the [variable] section
 	Steps     []RecipeStep
+	Finally   []RecipeStep // always run after the steps
+	Namespace string       // subdirectory in the recipe path directory
+	Dir       string       // recipe path directory, if found by searching
+	Shadowed  bool         // hidden by a recipe earlier in the recipe path
+}
+
+// recipeLoop is the state of an active foreach block.
+type recipeLoop struct {
+	start  int      // index of the foreach step
+	name   string   // loop variable name
+	items  []string // values to iterate over
+	index  int      // current iteration
+	saved  string   // value of the loop variable before the loop
+	exists bool     // the loop variable existed before the loop
 }
 
 // runRecipe runs a recipe.
-func runRecipe(opts CliOptions) {
+// It returns a *NotFoundError if the recipe does not exist, a *ParseError
+// if it is not valid, a *UsageError if the recipe options are not valid,
+// a *VariableError if required variables are not set and a *StepError if
+// a step failed.
+func runRecipe(opts CliOptions) error {
 	if len(opts.Flatten) > 0 {
-		runRecipeFlatten(opts)
-		return
+		return runRecipeFlatten(opts)
+	}
+	if len(opts.ShellScript) > 0 {
+		return runRecipeShellScript(opts)
 	}
 	// We need to load the recipe to get the variable names.
-	recipe := loadRecipe(opts.Recipe)
+	recipe, err := loadRecipe(opts.Recipe)
+	if err != nil {
+		return err
+	}
 
 	// Set the recipe variables.
-	runRecipeInitVariables(&recipe, opts)
+	// The values of the secret variables are masked in the log.
+	maskLogWriters()
+	if err := runRecipeInitVariables(&recipe, opts); err != nil {
+		return err
+	}
+
+	// Report the steps without running them.
+	if opts.Dryrun {
+		runRecipeDryrun(recipe)
+		return nil
+	}
+
+	// The context is cancelled if the recipe deadline expires or if the
+	// user interrupts the run. That kills the command that is running.
+	// The [finally] steps have their own context so that they run even if
+	// the recipe timed out or was interrupted. They can only be stopped by
+	// a second signal.
+	ctx, cancel := context.WithCancel(context.Background())
+	if recipe.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), recipe.Timeout)
+	}
+	defer cancel()
+	fctx, fcancel := context.WithCancel(context.Background())
+	defer fcancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			if ctx.Err() == nil {
+				Log.Warn("received signal %v, stopping", sig)
+				cancel()
+			} else {
+				Log.Warn("received signal %v, stopping the cleanup steps", sig)
+				fcancel()
+			}
+		}
+	}()
 
 	// Execute the steps.
-	for i, step := range recipe.Steps {
+	err = runRecipeSteps(ctx, opts, &recipe, recipe.Steps, "step")
+
+	// Execute the cleanup steps. They can use the status variable to find
+	// out what happened. The status is timeout if the recipe or the step
+	// that stopped it timed out.
+	if len(recipe.Finally) > 0 {
+		status := "passed"
+		if err != nil {
+			status = "failed"
+			serr, _ := err.(*StepError)
+			if ctx.Err() == context.DeadlineExceeded || (serr != nil && serr.Timeout()) {
+				status = "timeout"
+			} else if ctx.Err() == context.Canceled {
+				status = "interrupted"
+			}
+		}
+		key := strings.ToUpper(fmt.Sprintf("%v_status", Context.Base))
+		Log.Info("recipe status %v=%v", key, status)
+		recipe.Variables[key] = status
+		os.Setenv(key, status)
+		if ferr := runRecipeSteps(fctx, opts, &recipe, recipe.Finally, "finally"); ferr != nil {
+			if err == nil {
+				err = ferr
+			} else {
+				// The original error is returned, it is reported last.
+				Log.ErrNoExit("cleanup failed: %v", ferr)
+			}
+		}
+	}
+	return err
+}
+
+// runRecipeSteps runs the steps of a section. The name is "step" for the
+// [step] section and "finally" for the [finally] section, it is used in
+// the log messages and banners. It stops and returns an error if a step
+// fails.
+func runRecipeSteps(ctx context.Context, opts CliOptions, recipe *RecipeInfo, steps []RecipeStep, name string) error {
+	// The index is updated explicitly because conditional blocks can
+	// skip steps and loops can repeat them.
+	loops := []recipeLoop{}
+	for i := 0; i < len(steps); i++ {
+		step := steps[i]
+		next := i
+		if ctx.Err() != nil {
+			return runRecipeContextError(ctx, *recipe, i+1)
+		}
+
 		// Update the variables before each step.
 		// This is done here to allow the variables to be changed dynamically.
-		if strings.Contains(step.Data, "${") {
-			for key, val := range recipe.Variables {
-				variable := fmt.Sprintf("${%v}", key) // format is ${<name>}.
-				n := strings.Replace(step.Data, variable, val, -1)
-				if n != step.Data {
-					step.Data = n
-				}
-			}
+		data, e := runRecipeSubstituteVariables(step, *recipe)
+		if e != nil {
+			return &VariableRefError{Line: step.Line, Step: i + 1, Err: e}
 		}
+		step.Data = data
 
 		// Report step information.
 		if strings.Contains(step.Data, "\n") {
-			Log.Info("step.start = %v %v %v", i+1, step.DirectiveString, "multi-line")
+			Log.Info("%v.start = %v %v %v", name, i+1, step.DirectiveString, "multi-line")
 		} else {
-			Log.Info("step.start = %v %v %v", i+1, step.DirectiveString, step.Data)
+			Log.Info("%v.start = %v %v %v", name, i+1, step.DirectiveString, step.Data)
 		}
 		wd, _ := os.Getwd()
-		Log.Info("step.pwd = %v %v", i+1, wd)
+		Log.Info("%v.pwd = %v %v", name, i+1, wd)
 
 		// Run the step.
 		var buf bytes.Buffer
+		var err error
 		stepStart := time.Now()
-		runRecipeStepBanner(opts, step, i+1, recipe)
+		runRecipeStepBanner(opts, step, i+1, len(steps), name, *recipe, loops)
 		switch step.Directive {
 		case stepCd:
-			Chdir(step.Data)
-		case stepExec:
-			Log.Writers = append(Log.Writers, &buf) // push
-			RunCmd("%v", step.Data)
-			Log.Writers = Log.Writers[:len(Log.Writers)-1] // popd (no tos)
-		case stepExecNoExit:
-			Log.Writers = append(Log.Writers, &buf) // push
-			RunCmdNoExit("%v", step.Data)
-			Log.Writers = Log.Writers[:len(Log.Writers)-1] // popd (no tos)
+			Log.InfoWithLevel(3, "cd to %v", step.Data)
+			if e := os.Chdir(step.Data); e != nil {
+				err = newStepError(step, i+1, "failed to change directory to %v", step.Data)
+			}
+		case stepExec, stepExecNoExit:
+			err = runRecipeStepCmd(ctx, step, i+1, step.Data, &buf)
+			if err != nil {
+				err = runRecipeStepError(ctx, *recipe, step, i+1, stepStart, err)
+			}
 		case stepExport:
 			flds := strings.SplitN(step.Data, "=", 2)
 			key := flds[0]
 			val := flds[1]
-			err := os.Setenv(key, val)
-			if err != nil {
-				Log.Err("failed to set the environment variable '%v' - %v", key, err)
+			if e := os.Setenv(key, val); e != nil {
+				err = newStepError(step, i+1, "failed to set the environment variable '%v' - %v", key, e)
 			}
 		case stepInfo:
 			// Can't use Log.Info() here because the output will be lost if
@@ -133,62 +263,383 @@ func runRecipe(opts CliOptions) {
 			Log.Printf("%v\n", step.Data)
 		case stepMustExistDir:
 			if IsDir(step.Data) == false {
-				Log.Err("directory does not exist: %v", step.Data)
+				err = newStepError(step, i+1, "directory does not exist: %v", step.Data)
 			}
 		case stepMustExistFile:
 			if IsFile(step.Data) == false {
-				Log.Err("file does not exist: %v", step.Data)
+				err = newStepError(step, i+1, "file does not exist: %v", step.Data)
 			}
 		case stepMustNotExistDir:
 			if IsDir(step.Data) == true {
-				Log.Err("directory exists: %v", step.Data)
+				err = newStepError(step, i+1, "directory exists: %v", step.Data)
 			}
 		case stepMustNotExistFile:
 			if IsFile(step.Data) == true {
-				Log.Err("file exists: %v", step.Data)
+				err = newStepError(step, i+1, "file exists: %v", step.Data)
 			}
 		case stepScript:
 			// Create a temporary script and execute it.
-			MkdirAll(Context.ScriptDir, 0700)
-			fn := fmt.Sprintf("%v/%v.sh", Context.ScriptDir, Context.UserPID)
-			Log.Info("creating anonymous script file: %v", fn)
-			fp, err := os.Create(fn)
-			if err != nil {
-				Log.Err("can't create tmp file for script directive: %v", fn)
+			cmd, e := runRecipeCreateScript(step, i+1)
+			if e != nil {
+				err = newStepError(step, i+1, "%v", e)
+				break
 			}
-			fmt.Fprintf(fp, "%v", step.Data)
-			fp.Close()
-			os.Chmod(fn, 0700)
-			cmd := fn
 
 			// Run the command, capture the output so that we can check for
 			// updated variables (###export var=value)
-			Log.Writers = append(Log.Writers, &buf) // push
-			RunCmd(cmd)
-			Log.Writers = Log.Writers[:len(Log.Writers)-1] // popd (no tos)
+			err = runRecipeStepCmd(ctx, step, i+1, cmd, &buf)
 
 			// Cleanup.
-			Log.Info("deleting anonymous script file: %v", fn)
-			os.Remove(fn)
+			Log.Info("deleting anonymous script file: %v", cmd)
+			os.Remove(cmd)
+			if err != nil {
+				err = runRecipeStepError(ctx, *recipe, step, i+1, stepStart, err)
+			}
+		case stepIfVarSet, stepIfFileExists, stepIfEnv, stepIfOs:
+			if runRecipeCondition(step, *recipe) == false {
+				Log.Info("%v.skip = %v condition is false, continuing after step %v", name, i+1, step.Match+1)
+				next = step.Match
+			}
+		case stepElse:
+			// The if block ran so skip the else block.
+			next = step.Match
+		case stepEndif:
+			// Nothing to do, it marks the end of the block.
+		case stepParallel:
+			err = runRecipeParallel(ctx, recipe, steps, i)
+			next = step.Match
+		case stepForeach:
+			loop := runRecipeNewLoop(step, i, *recipe)
+			if len(loop.items) == 0 {
+				Log.Info("%v.skip = %v no items, continuing after step %v", name, i+1, step.Match+1)
+				next = step.Match
+				break
+			}
+			loops = append(loops, loop)
+			recipe.Variables[loop.name] = loop.items[0]
+			Log.Info("%v.iteration = %v 1 of %v %v = %v", name, i+1, len(loop.items), loop.name, loop.items[0])
+		case stepEndforeach:
+			loop := &loops[len(loops)-1]
+			loop.index++
+			if loop.index < len(loop.items) {
+				recipe.Variables[loop.name] = loop.items[loop.index]
+				Log.Info("%v.iteration = %v %v of %v %v = %v", name, loop.start+1, loop.index+1, len(loop.items), loop.name, loop.items[loop.index])
+				next = loop.start
+			} else {
+				// Done, restore the loop variable.
+				if loop.exists {
+					recipe.Variables[loop.name] = loop.saved
+				} else {
+					delete(recipe.Variables, loop.name)
+				}
+				loops = loops[:len(loops)-1]
+			}
 		default:
-			Log.Err("unrecognized directive %v (%v) in %v", step.Directive, step.DirectiveString, recipe.File)
+			err = newStepError(step, i+1, "unrecognized directive %v (%v)", step.Directive, step.DirectiveString)
 		}
-		runRecipeResetVariablesFromOutput(buf, &recipe)
-		Log.Info("step.end = %v %.03f", i+1, time.Since(stepStart).Seconds())
+		runRecipeResetVariablesFromOutput(buf, recipe)
+		Log.Info("%v.end = %v %.03f", name, i+1, time.Since(stepStart).Seconds())
+		if err != nil {
+			return err
+		}
+		i = next
 	}
+	return nil
+}
+
+// runRecipeStepCmd runs the command for a step with the output captured in
+// buf. If the command fails it is re-run as specified by the retry and
+// backoff modifiers. The error from the last attempt is returned.
+func runRecipeStepCmd(ctx context.Context, step RecipeStep, stepi int, cmd string, buf *bytes.Buffer) (err error) {
+	delay := step.Backoff
+	for attempt := 1; ; attempt++ {
+		buf.Reset() // only the output of the last attempt is checked for ###export
+		sctx, scancel := runRecipeStepContext(ctx, step)
+		Log.Writers = append(Log.Writers, buf) // push
+		err = RunCmdWithContext(sctx, "%v", cmd)
+		Log.Writers = Log.Writers[:len(Log.Writers)-1] // popd (no tos)
+		scancel()
+		if step.Retry > 0 {
+			Log.Info("step.attempt = %v %v of %v exit code %v", stepi, attempt, step.Retry+1, run.GetExitCode(err))
+		}
+		if err == nil || ctx.Err() != nil || attempt > step.Retry {
+			return
+		}
+		Log.Warn("step %v attempt %v of %v failed (%v) - %v, retrying in %v", stepi, attempt, step.Retry+1, run.GetExitCode(err), err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+}
+
+// runRecipeStepContext creates the context for a step that runs a command.
+// It expires after the step timeout, if one was specified.
+func runRecipeStepContext(ctx context.Context, step RecipeStep) (context.Context, context.CancelFunc) {
+	if step.Timeout > 0 {
+		return context.WithTimeout(ctx, step.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runRecipeStepError converts the error from a command into a step
+// failure. Failures of exec-no-exit steps are reported as warnings and
+// ignored unless the recipe was interrupted or timed out.
+func runRecipeStepError(ctx context.Context, recipe RecipeInfo, step RecipeStep, stepi int, stepStart time.Time, err error) error {
+	elapsed := time.Since(stepStart).Seconds()
+	li := step.Line
+	if ctx.Err() != nil {
+		return runRecipeContextError(ctx, recipe, stepi)
+	}
+	if err == context.DeadlineExceeded {
+		// The step timed out, not the recipe.
+		if step.Directive == stepExecNoExit {
+			Log.Warn("step %v timed out after %.03f seconds (timeout=%v) at line %v in %v", stepi, elapsed, step.Timeout, li.lineno, li.fi.abspath)
+			return nil
+		}
+		serr := newStepError(step, stepi, "step %v timed out after %.03f seconds (timeout=%v)", stepi, elapsed, step.Timeout)
+		serr.Err = err
+		return serr
+	}
+	code := run.GetExitCode(err)
+	if step.Directive == stepExecNoExit {
+		Log.Warn("step %v failed (%v) - %v at line %v in %v", stepi, code, err, li.lineno, li.fi.abspath)
+		return nil
+	}
+	serr := newStepError(step, stepi, "step %v failed (%v) - %v", stepi, code, err)
+	serr.Code = code
+	serr.Err = err
+	return serr
+}
+
+// runRecipeContextError reports why the recipe context is done.
+func runRecipeContextError(ctx context.Context, recipe RecipeInfo, stepi int) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &StepError{Step: stepi, Err: ctx.Err(), Msg: fmt.Sprintf("recipe timed out (timeout=%v) at step %v in %v", recipe.Timeout, stepi, recipe.File)}
+	}
+	return &StepError{Step: stepi, Err: ctx.Err(), Msg: fmt.Sprintf("recipe interrupted at step %v in %v", stepi, recipe.File)}
+}
+
+// runRecipeCreateScript creates the anonymous script file for a script
+// step. The step number is part of the file name so that scripts that
+// run concurrently do not collide.
+func runRecipeCreateScript(step RecipeStep, stepi int) (fn string, err error) {
+	if err = os.MkdirAll(Context.ScriptDir, 0700); err != nil {
+		err = fmt.Errorf("mkdir operation failed for '%v': %v", Context.ScriptDir, err)
+		return
+	}
+	fn = fmt.Sprintf("%v/%v-%v.sh", Context.ScriptDir, Context.UserPID, stepi)
+	Log.Info("creating anonymous script file: %v", fn)
+	fp, err := os.Create(fn)
+	if err != nil {
+		err = fmt.Errorf("can't create tmp file for script directive: %v", fn)
+		return
+	}
+	fmt.Fprintf(fp, "%v", step.Data)
+	fp.Close()
+	os.Chmod(fn, 0700)
+	return
+}
+
+// runRecipeNewLoop creates the loop state for a foreach step.
+// The data has the form "<name> in <items>" where the items are
+// separated by white space or commas.
+func runRecipeNewLoop(step RecipeStep, i int, recipe RecipeInfo) (loop recipeLoop) {
+	flds := strings.Fields(strings.Replace(step.Data, ",", " ", -1))
+	loop.start = i
+	loop.name = flds[0]
+	loop.items = flds[2:]
+	loop.saved, loop.exists = recipe.Variables[loop.name]
+	return
+}
+
+// runRecipeCondition evaluates the condition for an if directive.
+func runRecipeCondition(step RecipeStep, recipe RecipeInfo) (result bool) {
+	switch step.Directive {
+	case stepIfVarSet:
+		// if-var-set NAME
+		val, ok := recipe.Variables[step.Data]
+		result = ok && val != ""
+	case stepIfFileExists:
+		// if-file-exists PATH
+		result = PathExists(step.Data)
+	case stepIfEnv:
+		// if-env NAME or if-env NAME=VALUE
+		flds := strings.SplitN(step.Data, "=", 2)
+		val, ok := os.LookupEnv(flds[0])
+		if len(flds) == 1 {
+			result = ok
+		} else {
+			result = ok && val == flds[1]
+		}
+	case stepIfOs:
+		// if-os OS [OS ...]
+		for _, t := range strings.Fields(step.Data) {
+			if t == Context.OsType {
+				result = true
+				break
+			}
+		}
+	}
+	Log.Info("step.condition = %v %v -> %v", step.DirectiveString, step.Data, result)
+	return
+}
+
+// runRecipeUnresolved records the unresolved references that have been
+// reported so that a step in a loop only reports them once.
+var runRecipeUnresolved = map[string]bool{}
+
+// runRecipeSubstituteVariables replaces the ${<name>} references in the
+// step data with the current recipe variable values. It warns about the
+// references to names that are not variables because they are passed
+// through as they are, that is usually a typo unless the step is a
+// script that uses its own shell variables, those should be escaped.
+func runRecipeSubstituteVariables(step RecipeStep, recipe RecipeInfo) (string, error) {
+	for _, name := range unresolvedVariableRefs(step.Data, recipe.Variables) {
+		key := fmt.Sprintf("%v:%v:%v", step.Line.fi.abspath, step.Line.lineno, name)
+		if runRecipeUnresolved[key] == false {
+			runRecipeUnresolved[key] = true
+			Log.Warn("unresolved reference '${%v}' at line %v in %v, use '$${%v}' for a literal '${%v}'", name, step.Line.lineno, step.Line.fi.abspath, name, name)
+		}
+	}
+	return interpolateString(step.Data, recipe.Variables)
+}
+
+// runRecipeDryrun reports what each step would do without running it.
+// The working directory is tracked for cd steps so that the reported
+// directory is the one the step would actually run in.
+func runRecipeDryrun(recipe RecipeInfo) {
+	wd, _ := os.Getwd()
+	Log.Printf("# dry run: %v - %v\n", recipe.Name, recipe.File)
+	if recipe.Timeout > 0 {
+		Log.Printf("# timeout: %v\n", recipe.Timeout)
+	}
+
+	// Report the variables, skipping the built-in environment variables.
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	ks := []string{}
+	for k := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) == false {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		v := recipe.Variables[k]
+		if recipe.Decls[k].Secret {
+			v = secretMask
+		}
+		Log.Printf("# variable: %v = %v\n", k, strconv.Quote(v))
+	}
+
+	wd = runRecipeDryrunSteps(recipe, recipe.Steps, "step", wd)
+	if len(recipe.Finally) > 0 {
+		// The status is not known in a dry run.
+		Log.Printf("\n")
+		Log.Printf("# finally: always runs after the steps\n")
+		runRecipeDryrunSteps(recipe, recipe.Finally, "finally step", wd)
+	}
+}
+
+// runRecipeDryrunSteps reports the steps of a section for a dry run. It
+// returns the working directory after the steps.
+func runRecipeDryrunSteps(recipe RecipeInfo, steps []RecipeStep, label string, wd string) string {
+	// The foreach blocks are reported once for each item with the loop
+	// variable set, like they are run, so that the references to it are
+	// resolved.
+	loops := []recipeLoop{}
+	for i := 0; i < len(steps); i++ {
+		step := steps[i]
+		data, err := runRecipeSubstituteVariables(step, recipe)
+		step.Data = data
+		Log.Printf("\n")
+		Log.Printf("%v %v of %v - line %v in %v\n", label, i+1, len(steps), step.Line.lineno, step.Line.fi.abspath)
+		Log.Printf("    directive : %v\n", step.DirectiveString)
+		for _, loop := range loops {
+			Log.Printf("    iteration : %v of %v (%v = %v)\n", loop.index+1, len(loop.items), loop.name, loop.items[loop.index])
+		}
+		if err != nil {
+			Log.Printf("    error     : %v\n", err)
+		}
+		if m := getRecipeStepModifierString(step); m != "" {
+			Log.Printf("    modifiers : %v\n", strings.TrimSpace(m))
+		}
+		Log.Printf("    pwd       : %v\n", wd)
+		switch step.Directive {
+		case stepScript:
+			Log.Printf("    script    :\n")
+			for _, line := range strings.Split(step.Data, "\n") {
+				Log.Printf("        %v\n", line)
+			}
+			if strings.Contains(step.Data, "###export") {
+				Log.Printf("    note      : ###export updates are not applied in a dry run\n")
+			}
+		case stepCd:
+			Log.Printf("    data      : %v\n", step.Data)
+			if path.IsAbs(step.Data) {
+				wd = path.Clean(step.Data)
+			} else {
+				wd = path.Join(wd, step.Data)
+			}
+		case stepForeach:
+			Log.Printf("    data      : %v\n", step.Data)
+			loop := runRecipeNewLoop(step, i, recipe)
+			if len(loop.items) == 0 {
+				Log.Printf("    note      : no items, the block is skipped\n")
+				i = step.Match
+				break
+			}
+			loops = append(loops, loop)
+			recipe.Variables[loop.name] = loop.items[0]
+		case stepEndforeach:
+			Log.Printf("    data      : %v\n", step.Data)
+			loop := &loops[len(loops)-1]
+			loop.index++
+			if loop.index < len(loop.items) {
+				recipe.Variables[loop.name] = loop.items[loop.index]
+				i = loop.start
+			} else {
+				if loop.exists {
+					recipe.Variables[loop.name] = loop.saved
+				} else {
+					delete(recipe.Variables, loop.name)
+				}
+				loops = loops[:len(loops)-1]
+			}
+		default:
+			if strings.Contains(step.Data, "\n") {
+				Log.Printf("    data      :\n")
+				for _, line := range strings.Split(step.Data, "\n") {
+					Log.Printf("        %v\n", line)
+				}
+			} else {
+				Log.Printf("    data      : %v\n", step.Data)
+			}
+		}
+	}
+	return wd
 }
 
 // runRecipeStepBanner displays the banner for each step.
-func runRecipeStepBanner(opts CliOptions, step RecipeStep, stepi int, recipe RecipeInfo) {
+func runRecipeStepBanner(opts CliOptions, step RecipeStep, stepi int, nsteps int, name string, recipe RecipeInfo, loops []recipeLoop) {
 	if opts.Banner == false || opts.Verbose < 2 {
 		return
 	}
-	p := 100. * (float64(stepi) / float64(len(recipe.Steps)))
+	p := 100. * (float64(stepi) / float64(nsteps))
 	Log.Printf("\n")
 	Log.Printf("# ================================================================\n")
-	Log.Printf("# Step %v of %v (%.02f%%%%)\n", stepi, len(recipe.Steps), p)
+	if name == "finally" {
+		Log.Printf("# Finally Step %v of %v (%.02f%%%%)\n", stepi, nsteps, p)
+	} else {
+		Log.Printf("# Step %v of %v (%.02f%%%%)\n", stepi, nsteps, p)
+	}
 	Log.Printf("# Recipe Name: %v\n", recipe.Name)
 	Log.Printf("# Recipe File: %v\n", recipe.File)
+	for _, loop := range loops {
+		Log.Printf("# Iteration: %v of %v (%v = %v)\n", loop.index+1, len(loop.items), loop.name, loop.items[loop.index])
+	}
 	Log.Printf("#\n")
 
 	if strings.Contains(step.Data, "\n") {
@@ -197,13 +648,13 @@ func runRecipeStepBanner(opts CliOptions, step RecipeStep, stepi int, recipe Rec
 			if i > 0 {
 				Log.Printf("# %v\n", line)
 			} else {
-				Log.Printf("# step = %v \"\"\"%v\n", step.DirectiveString, line)
+				Log.Printf("# step = %v%v \"\"\"%v\n", getRecipeStepModifierString(step), step.DirectiveString, line)
 			}
 		}
 		Log.Printf("# \"\"\"\n")
 	} else {
 		q := strconv.Quote(step.Data)
-		Log.Printf("# step = %v %v\n", step.DirectiveString, q)
+		Log.Printf("# step = %v%v %v\n", getRecipeStepModifierString(step), step.DirectiveString, q)
 	}
 	// TODO: add more context information here, the recipe details.
 	Log.Printf("# ================================================================\n")
@@ -233,13 +684,16 @@ func runRecipeResetVariablesFromOutput(buf bytes.Buffer, recipe *RecipeInfo) {
 					if eval[0] == '"' {
 						x, e := strconv.Unquote(eval)
 						if e != nil {
-							Log.Warn("unquote error for '%v' -- cannot update")
+							Log.Warn("unquote error for '%v' -- cannot update", eval)
 							continue
 						}
 						eval = x
 					}
 
 					// Change the value for subsequent steps.
+					if recipe.Decls[ekey].Secret {
+						addSecretValue(eval)
+					}
 					val, ok := recipe.Variables[ekey]
 					if ok {
 						if eval != val {
@@ -258,7 +712,7 @@ func runRecipeResetVariablesFromOutput(buf bytes.Buffer, recipe *RecipeInfo) {
 }
 
 // runRecipeInitVariables initializes the recipe variables.
-func runRecipeInitVariables(recipe *RecipeInfo, opts CliOptions) {
+func runRecipeInitVariables(recipe *RecipeInfo, opts CliOptions) (err error) {
 	// Use the recipe variable names to check the extra arguments.
 	// Convert the arguments to options.
 	ropts := map[string]string{}
@@ -268,13 +722,42 @@ func runRecipeInitVariables(recipe *RecipeInfo, opts CliOptions) {
 		ropts[o] = k
 		ks = append(ks, o)
 	}
+	for k, v := range recipe.Decls {
+		if v.Short != "" {
+			ropts["-"+v.Short] = k
+		}
+	}
 
 	// Check the options.
+	// The options can be specified as --name value or --name=value. Bool
+	// variables are set by --name and cleared by --no-name. The values of
+	// list variables accumulate when the option is repeated. The arguments
+	// after -- are passed to the steps in ${CB_ARGS}.
+	args := []string{}
+	lists := map[string]bool{} // list variables that were set
+	set := map[string]bool{}   // variables that were set, their sources are not evaluated
 	for i := 0; i < len(opts.ExtraArgs); i++ {
 		opt := opts.ExtraArgs[i]
+		if opt == "--" {
+			args = opts.ExtraArgs[i+1:]
+			break
+		}
+
+		// Split --name=value.
+		val := ""
+		inline := false
+		if p := strings.Index(opt, "="); p > 0 && opt[0] == '-' {
+			opt, val, inline = opt[:p], opt[p+1:], true
+		}
 
 		// Make sure that the option is valid.
-		_, ok := ropts[opt]
+		key, ok := ropts[opt]
+		negate := false
+		if ok == false && strings.HasPrefix(opt, "--no-") {
+			key, ok = ropts["--"+opt[5:]]
+			ok = ok && recipe.Decls[key].Type.Kind == "bool"
+			negate = ok
+		}
 		if ok == false {
 			// Don't print the environment variables, they only confuse things.
 			vks := []string{} // visible variables
@@ -291,65 +774,122 @@ func runRecipeInitVariables(recipe *RecipeInfo, opts CliOptions) {
 
 			// If visible variables are present, show them.
 			if len(vks) > 0 {
-				Log.Err("invalid option specified '%v', valid options are %v", opt, vks)
+				err = &UsageError{Msg: fmt.Sprintf("invalid option specified '%v', valid options are %v", opt, vks)}
 			} else {
-				Log.Err("invalid option specified '%v', there are no valid options", opt)
+				err = &UsageError{Msg: fmt.Sprintf("invalid option specified '%v', there are no valid options", opt)}
 			}
+			return
 		}
 
-		// Now get the value.
-		i++
-		if i >= len(opts.ExtraArgs) {
-			Log.Err("missing argument for '%v'", opt)
+		// Now get the value, bool options do not need one.
+		switch {
+		case negate:
+			if inline {
+				err = &UsageError{Msg: fmt.Sprintf("option '%v' does not accept a value", opt)}
+				return
+			}
+			val = "false"
+		case inline:
+		case recipe.Decls[key].Type.Kind == "bool":
+			val = "true"
+		default:
+			i++
+			if i >= len(opts.ExtraArgs) {
+				err = &UsageError{Msg: fmt.Sprintf("missing argument for '%v'", opt)}
+				return
+			}
+			val = opts.ExtraArgs[i]
+		}
+		if recipe.Decls[key].List {
+			// The first value replaces the default.
+			if lists[key] {
+				val = recipe.Variables[key] + " " + val
+			}
+			lists[key] = true
 		}
-		val := opts.ExtraArgs[i]
-		key := ropts[opt]
 		recipe.Variables[key] = val
+		set[key] = true
+	}
+
+	// Prompt for the secret variables that do not have a value so that
+	// they do not have to be specified on the command line. The values
+	// are masked in the log from here on.
+	pks := []string{}
+	for k, d := range recipe.Decls {
+		if d.Secret && recipe.Variables[k] == "" {
+			pks = append(pks, k)
+		}
+	}
+	sort.Strings(pks)
+	for _, k := range pks {
+		val, ok, e := promptSecret(k)
+		if e != nil {
+			err = e
+			return
+		}
+		if ok {
+			recipe.Variables[k] = val
+			set[k] = true
+		}
 	}
+	addSecrets(*recipe)
 
 	// Verify that all of the required variables have values.
-	en := 0
+	// The pass through arguments are allowed to be empty, they may be
+	// inherited from the environment when cb is run by a step.
+	argsKey := strings.ToUpper(fmt.Sprintf("%v_ARGS", Context.Base))
+	unset := []string{}
 	for key, val := range recipe.Variables {
-		if val == "" {
-			en++
-			Log.ErrNoExit("option '--%v' has no value", key)
+		if val == "" && key != argsKey {
+			unset = append(unset, key)
 		}
 	}
-	if en > 0 {
-		Log.Err("unset variables found, cannot continue")
+	if len(unset) > 0 {
+		sort.Strings(unset)
+		err = &VariableError{Names: unset}
+		return
+	}
+
+	// The pass through arguments are quoted so that they are split the
+	// same way as the arguments of an exec step or a script command.
+	qargs := []string{}
+	for _, arg := range args {
+		qargs = append(qargs, shellQuoteLiteral(arg))
 	}
+	recipe.Variables[argsKey] = strings.Join(qargs, " ")
+	os.Setenv(argsKey, recipe.Variables[argsKey])
 
-	// Do the variable substitution for all variables.
+	// Do the variable substitution for all variables and compute the
+	// defaults that have a source.
 	// The substitutions for the steps are done just-in-time to
 	// allow the variable values to be updated dynamically.
-	for key, val := range recipe.Variables {
-		variable := fmt.Sprintf("${%v}", key)
-
-		// Replace all occurrences of the variable in the value portion
-		// of the variables. This does not affect the outer loop because
-		// we are not changing the key.
-		for n1, v1 := range recipe.Variables {
-			if n1 != key { // skip ourself
-				v2 := strings.Replace(v1, variable, val, -1)
-				if v2 != v1 {
-					recipe.Variables[n1] = v2
-				}
-			}
-		}
+	pending, err := interpolateRecipeVariables(recipe, set, opts.Dryrun)
+	if err != nil {
+		return
 	}
+	addSecrets(*recipe) // the computed values
+
+	// Validate the typed variables before any step runs.
+	err = checkRecipeVariableTypes(recipe, pending)
+	return
 }
 
 // runRecipeFlatten flattens a recipe for debugging.
-func runRecipeFlatten(opts CliOptions) {
+func runRecipeFlatten(opts CliOptions) (err error) {
 	Log.Info("flattening recipe %v to %v", opts.Recipe, opts.Flatten)
 
 	// We need to load the recipe to get the variable names.
-	recipe := loadRecipe(opts.Recipe)
+	recipe, err := loadRecipe(opts.Recipe)
+	if err != nil {
+		return
+	}
 
 	fp, err := os.Create(opts.Flatten)
 	if err != nil {
-		Log.Err("unable to create file %v", opts.Flatten)
+		err = fmt.Errorf("unable to create file %v", opts.Flatten)
+		return
 	}
+	defer fp.Close()
 
 	// description section
 	fmt.Fprintf(fp, "[description]\n")
@@ -360,6 +900,9 @@ func runRecipeFlatten(opts CliOptions) {
 	} else {
 		fmt.Fprintf(fp, "full = %v", strconv.Quote(recipe.Full))
 	}
+	if recipe.Timeout > 0 {
+		fmt.Fprintf(fp, "\ntimeout = %v", recipe.Timeout)
+	}
 
 	// variable section
 	if len(recipe.Variables) > 0 {
@@ -373,48 +916,83 @@ func runRecipeFlatten(opts CliOptions) {
 		for _, k := range ks {
 			fmt.Fprintf(fp, "%v = ", k)
 			val := recipe.Variables[k]
+			d := recipe.Decls[k]
+			if d.Secret && d.Source == "" && val != "" {
+				val = secretMask // redacted, a source is not a secret
+			}
 			if strings.Contains(val, "\n") {
 				fmt.Fprintf(fp, "\"\"\"\n%v\n\"\"\"", val)
 			} else {
 				fmt.Fprintf(fp, "%v", strconv.Quote(val))
 			}
 			fmt.Fprintf(fp, "\n")
+			if d.Type.Kind != "" {
+				fmt.Fprintf(fp, "%v.type = %v\n", k, strconv.Quote(d.Type.String()))
+			}
+			if d.Doc != "" {
+				fmt.Fprintf(fp, "%v.doc = %v\n", k, strconv.Quote(d.Doc))
+			}
+			if d.Short != "" {
+				fmt.Fprintf(fp, "%v.short = %v\n", k, d.Short)
+			}
+			if d.List {
+				fmt.Fprintf(fp, "%v.list = true\n", k)
+			}
+			if d.Secret {
+				fmt.Fprintf(fp, "%v.secret = true\n", k)
+			}
 		}
 	}
 
 	// step section
-	if len(recipe.Steps) > 0 {
-		fmt.Fprintf(fp, "\n")
-		fmt.Fprintf(fp, "[step]\n")
+	runRecipeFlattenSteps(fp, "[step]", "Step", recipe.Steps)
 
-		for i, step := range recipe.Steps {
-			if i > 0 {
-				fmt.Fprintf(fp, "\n")
-			}
-			fmt.Fprintf(fp, "# Step %v\n", i+1)
-			fmt.Fprintf(fp, "step = %v ", step.DirectiveString)
-			if strings.Contains(step.Data, "\n") {
-				fmt.Fprintf(fp, "\"\"\"\n%v\n\"\"\"", step.Data)
-			} else {
-				fmt.Fprintf(fp, "%v", strconv.Quote(step.Data))
-			}
+	// finally section
+	runRecipeFlattenSteps(fp, "[finally]", "Finally Step", recipe.Finally)
+	Log.Info("done")
+	return
+}
+
+// runRecipeFlattenSteps writes the steps of a section.
+func runRecipeFlattenSteps(fp *os.File, section string, label string, steps []RecipeStep) {
+	if len(steps) == 0 {
+		return
+	}
+	fmt.Fprintf(fp, "\n")
+	fmt.Fprintf(fp, "%v\n", section)
+
+	for i, step := range steps {
+		if i > 0 {
 			fmt.Fprintf(fp, "\n")
 		}
+		fmt.Fprintf(fp, "# %v %v\n", label, i+1)
+		fmt.Fprintf(fp, "step = %v%v ", getRecipeStepModifierString(step), step.DirectiveString)
+		if len(step.Data) == 0 {
+			// else and endif do not have data
+		} else if strings.Contains(step.Data, "\n") {
+			fmt.Fprintf(fp, "\"\"\"\n%v\n\"\"\"", step.Data)
+		} else {
+			fmt.Fprintf(fp, "%v", strconv.Quote(step.Data))
+		}
+		fmt.Fprintf(fp, "\n")
 	}
-	Log.Info("done")
 }
 
 // loadRecipe loads a recipe.
-func loadRecipe(recipeRef string) (recipe RecipeInfo) {
+func loadRecipe(recipeRef string) (recipe RecipeInfo, err error) {
 	if len(recipeRef) == 0 {
-		Log.Err("null recipes not allowed")
+		err = fmt.Errorf("null recipes not allowed")
+		return
 	}
 	Log.Info("loading recipe '%v'", recipeRef)
 	recipeFile := ""
+	recipeDir := ""
 	if IsFile(recipeRef) {
 		recipeFile = recipeRef
 	} else {
-		recipeFile = recipeRef
+		// Recipes in subdirectories can be referenced as group/name or
+		// group:name.
+		recipeFile = strings.Replace(recipeRef, ":", "/", -1)
 
 		// Add the INI extension.
 		// This will catch things like ./foo --> ./foo.ini
@@ -423,16 +1001,36 @@ func loadRecipe(recipeRef string) (recipe RecipeInfo) {
 			recipeFile = fmt.Sprintf("%v.ini", recipeFile)
 		}
 
-		// Prepend the recipes directory structure.
+		// Search the recipe path, the first match wins.
 		if recipeFile[0] != '/' {
-			Log.Info("prepending directory path: '%v'", Context.RecipeDir)
-			recipeFile = path.Join(Context.RecipeDir, recipeFile)
+			recipeDir = findRecipeDir(recipeFile)
+			if recipeDir == "" {
+				err = &NotFoundError{File: recipeRef, Path: Context.RecipePath}
+				return
+			}
+			Log.Info("prepending directory path: '%v'", recipeDir)
+			recipeFile = path.Join(recipeDir, recipeFile)
 		}
 	}
 	Log.Info("recipe file '%v'", recipeFile)
+	if IsFile(recipeFile) == false {
+		err = &NotFoundError{File: recipeFile}
+		return
+	}
 	nested := map[string]int{}
-	lines := readRecipeFile(recipeFile, nested)
-	recipe = makeRecipe(recipeFile, lines)
+	lines, err := readRecipeFile(recipeFile, nested)
+	if err != nil {
+		return
+	}
+	recipe, err = makeRecipe(recipeFile, lines)
+	if err != nil {
+		return
+	}
+	if recipeDir != "" {
+		recipe.Dir = recipeDir
+		rel, _ := filepath.Rel(recipeDir, recipeFile)
+		setRecipeNamespace(&recipe, rel)
+	}
 
 	// Update the recipe with the environment variables.
 	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
@@ -447,57 +1045,158 @@ func loadRecipe(recipeRef string) (recipe RecipeInfo) {
 	return
 }
 
-// listAllRecipes lists all of the recipes with their brief descriptions.
-func listAllRecipes() {
-	recipes := loadAllRecipes()
+// findRecipeDir finds the first directory in the recipe path that
+// contains the recipe file.
+func findRecipeDir(recipeFile string) string {
+	for _, dir := range Context.RecipePath {
+		if IsFile(path.Join(dir, recipeFile)) {
+			return dir
+		}
+		Log.Info("recipe %v not found in %v", recipeFile, dir)
+	}
+	return ""
+}
 
-	// Get the maximum width for the name field to allign all of the brief
-	// descriptions.
+// listAllRecipes lists all of the recipes with their brief descriptions
+// and the directory that they came from, grouped by namespace. Recipes
+// that are hidden by a recipe with the same name in a directory that is
+// earlier in the recipe path are marked as shadowed.
+// With --format json or yaml it writes the full recipes instead.
+func listAllRecipes(opts CliOptions) (err error) {
+	recipes, err := loadAllRecipes()
+	if err != nil {
+		return
+	}
+	if opts.Format != "text" {
+		return writeCatalog(opts.Format, recipes, false)
+	}
+
+	// Get the maximum width for the name and brief fields to allign all of
+	// the brief descriptions and directories.
 	m := 0
+	b := 0
 	for _, recipe := range recipes {
 		if len(recipe.Name) > m {
 			m = len(recipe.Name)
 		}
+		if len(recipe.Brief) > b {
+			b = len(recipe.Brief)
+		}
 	}
 
+	// Group the recipes by namespace. The sort is stable so the shadowed
+	// recipes follow the recipe that shadows them.
+	sort.SliceStable(recipes, func(i, j int) bool {
+		if recipes[i].Namespace != recipes[j].Namespace {
+			return recipes[i].Namespace < recipes[j].Namespace
+		}
+		return recipes[i].Name < recipes[j].Name
+	})
+
 	// Print out the data.
-	for _, recipe := range recipes {
-		fmt.Printf("%-*s - %v\n", m, recipe.Name, recipe.Brief)
+	for i, recipe := range recipes {
+		if i == 0 || recipe.Namespace != recipes[i-1].Namespace {
+			if recipe.Namespace != "" {
+				if i > 0 {
+					fmt.Printf("\n")
+				}
+				fmt.Printf("%v:\n", recipe.Namespace)
+			}
+		}
+		if recipe.Shadowed {
+			fmt.Printf("%-*s - %-*s  [%v, shadowed]\n", m, recipe.Name, b, recipe.Brief, recipe.Dir)
+		} else {
+			fmt.Printf("%-*s - %-*s  [%v]\n", m, recipe.Name, b, recipe.Brief, recipe.Dir)
+		}
 	}
+	return
 }
 
-// loadAllRecipes loads all of the recipes in the path
-func loadAllRecipes() (recipes []RecipeInfo) {
-	files, e := ioutil.ReadDir(Context.RecipeDir)
-	if e != nil {
-		Log.Err("cannot read recipes directory: %v - %v", Context.RecipeDir, e)
-	}
-	for _, file := range files {
-		if file.IsDir() {
+// loadAllRecipes loads all of the recipes in the recipe path in the order
+// that they are found. A recipe that has the same name as one that was
+// found earlier is shadowed.
+func loadAllRecipes() (recipes []RecipeInfo, err error) {
+	seen := map[string]bool{}
+	for _, dir := range Context.RecipePath {
+		if IsDir(dir) == false {
+			Log.Info("skipping recipe directory that does not exist: %v", dir)
 			continue
 		}
-		recipeFile := path.Join(Context.RecipeDir, file.Name())
-		if strings.HasSuffix(recipeFile, ".ini") {
-			// .ini files are recipe files.
-			nested := map[string]int{}
-			lines := readRecipeFile(recipeFile, nested)
-			recipe := makeRecipe(recipeFile, lines)
+		rs, e := loadRecipesInDir(dir)
+		if e != nil {
+			err = e
+			return
+		}
+		for _, recipe := range rs {
+			recipe.Shadowed = seen[recipe.Name]
+			seen[recipe.Name] = true
 			recipes = append(recipes, recipe)
 		}
 	}
 	return
 }
 
+// loadRecipesInDir loads all of the recipes in a directory and its
+// subdirectories. The recipes in a subdirectory are in the namespace of
+// the subdirectory. Hidden directories are skipped.
+func loadRecipesInDir(dir string) (recipes []RecipeInfo, err error) {
+	err = filepath.Walk(dir, func(recipeFile string, file os.FileInfo, e error) error {
+		if e != nil {
+			return fmt.Errorf("cannot read recipes directory: %v - %v", recipeFile, e)
+		}
+		if file.IsDir() {
+			if recipeFile != dir && strings.HasPrefix(file.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(recipeFile, ".ini") == false {
+			return nil
+		}
+
+		// .ini files are recipe files.
+		nested := map[string]int{}
+		lines, e := readRecipeFile(recipeFile, nested)
+		if e != nil {
+			return e
+		}
+		recipe, e := makeRecipe(recipeFile, lines)
+		if e != nil {
+			return e
+		}
+		recipe.Dir = dir
+		rel, _ := filepath.Rel(dir, recipeFile)
+		setRecipeNamespace(&recipe, rel)
+		recipes = append(recipes, recipe)
+		return nil
+	})
+	return
+}
+
+// setRecipeNamespace sets the name and namespace of a recipe from the
+// path of the recipe file relative to the recipe path directory.
+// Example: build/linux/debug.ini --> build/linux/debug in build/linux.
+func setRecipeNamespace(recipe *RecipeInfo, rel string) {
+	rel = filepath.ToSlash(strings.TrimSuffix(rel, ".ini"))
+	recipe.Name = rel
+	recipe.Namespace = ""
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		recipe.Namespace = rel[:i]
+	}
+}
+
 // readRecipeFile reads a file line by line and returns all of the lines.
-func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
+func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo, err error) {
 	if _, e := os.Stat(fname); os.IsNotExist(e) {
-		Log.Err("recipe file does not exist: %v", fname)
+		err = &NotFoundError{File: fname}
+		return
 	}
 
 	// Check for nested references that could lead to infinite recursion.
 	a, e := filepath.Abs(fname)
 	if e != nil {
-		Log.Err("cannot get abspath for recipe %v", a)
+		err = &ParseError{File: fname, Msg: fmt.Sprintf("cannot get abspath for recipe - %v", e)}
+		return
 	}
 	if _, ok := nested[a]; ok {
 		// nested include found, report the stack
@@ -506,7 +1205,8 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 			Log.Info("nested %3d %v", i, k)
 			i++
 		}
-		Log.Err("nested include found - infinite recursion: %v\n", a)
+		err = &ParseError{File: a, Msg: "nested include found - infinite recursion"}
+		return
 	}
 	nested[a] = 1
 
@@ -514,6 +1214,7 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 	fi := FileInfo{fname: fname, base: filepath.Base(a), abspath: a, dir: filepath.Dir(a)}
 	fp, e := os.Open(fname)
 	if e != nil {
+		err = &ParseError{File: a, Msg: fmt.Sprintf("cannot read recipe - %v", e)}
 		return
 	}
 	defer fp.Close()
@@ -534,7 +1235,8 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 				if ifn[0] == '"' {
 					ifn, e = strconv.Unquote(ifn)
 					if e != nil {
-						panic(e)
+						err = newParseError(LineInfo{fi: &fi, lineno: lineno, line: line}, "syntax error, invalid include file name")
+						return
 					}
 				}
 				if ifn[0] != '/' {
@@ -542,13 +1244,21 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 					// the path to the original file as the base directory.
 					ifn = path.Join(fi.dir, ifn)
 				}
-				ilines := readRecipeFile(ifn, nested)
+				if IsFile(ifn) == false {
+					err = newParseError(LineInfo{fi: &fi, lineno: lineno, line: line}, "include file does not exist: %v", ifn)
+					return
+				}
+				ilines, e := readRecipeFile(ifn, nested)
+				if e != nil {
+					err = e
+					return
+				}
 				lines = append(lines, ilines...)
 				continue
 			} else {
 				// Syntax error.
-				Log.Err("syntax error at include statement at line %v in %v", lineno, fi.abspath)
-				continue
+				err = newParseError(LineInfo{fi: &fi, lineno: lineno, line: line}, "syntax error at include statement")
+				return
 			}
 		} else if len(x) == 0 || x[0] == '#' {
 			// Skip blank lines and comments.
@@ -567,8 +1277,8 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 			re1 := regexp.MustCompile(`^\S+\s*=\s*"""`)
 			re2 := regexp.MustCompile(`"""$`)
 			re3 := regexp.MustCompile(`^(\S+\s*=)\s*"""(.+)"""\s*$`)
-			re4 := regexp.MustCompile(`^\S+\s*=\s*script\s+"""\s*(.*)$`)
-			re5 := regexp.MustCompile(`^\S+\s*=\s*info\s+"""\s*(.*)$`)
+			re4 := regexp.MustCompile(`^\S+\s*=\s*(?:[a-z]+=\S+\s+)*script\s+"""\s*(.*)$`)
+			re5 := regexp.MustCompile(`^\S+\s*=\s*(?:[a-z]+=\S+\s+)*info\s+"""\s*(.*)$`)
 			if re3.MatchString(x) {
 				// It is all on a single line.
 				// Example:
@@ -580,6 +1290,7 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 			} else if re1.MatchString(x) {
 				// Now parse until the end of the string.
 				f := false
+				start := LineInfo{fi: &fi, lineno: lineno, line: line}
 				for ; s.Scan(); lineno++ {
 					sline := s.Text()
 					line += "\n"
@@ -592,12 +1303,14 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 					}
 				}
 				if f == false {
-					Log.Err("syntax error: end of multiline string not found, starts at line %v in %v", lineno, fi.abspath)
+					err = newParseError(start, "syntax error: end of multiline string not found, starts")
+					return
 				}
 			} else if re4.MatchString(x) || re5.MatchString(x) {
 				// Now parse until the end of the string.
 				// Only for script and info.
 				f := false
+				start := LineInfo{fi: &fi, lineno: lineno, line: line}
 				for ; s.Scan(); lineno++ {
 					sline := s.Text()
 					line += "\n"
@@ -610,7 +1323,8 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 					}
 				}
 				if f == false {
-					Log.Err("syntax error: end of multiline string not found, starts at line %v in %v", lineno, fi.abspath)
+					err = newParseError(start, "syntax error: end of multiline string not found, starts")
+					return
 				}
 			}
 		}
@@ -624,17 +1338,25 @@ func readRecipeFile(fname string, nested map[string]int) (lines []LineInfo) {
 }
 
 // makeRecipe makes the recipe object.
-func makeRecipe(recipeFile string, lines []LineInfo) (rec RecipeInfo) {
+func makeRecipe(recipeFile string, lines []LineInfo) (rec RecipeInfo, err error) {
 	// Populate the recipe with initial values.
-	n, a := getRecipeName(recipeFile)
+	n, a, e := getRecipeName(recipeFile)
+	if e != nil {
+		err = &ParseError{File: recipeFile, Msg: e.Error()}
+		return
+	}
 	rec = RecipeInfo{
 		Name:      n,
 		File:      a,
 		Variables: map[string]string{},
-		Steps:     []RecipeStep{}}
+		Decls:     map[string]RecipeVariable{},
+		Steps:     []RecipeStep{},
+		Finally:   []RecipeStep{}}
 
 	// Verify that no statements exist outside of a section.
-	checkValidSections(recipeFile, lines)
+	if err = checkValidSections(recipeFile, lines); err != nil {
+		return
+	}
 
 	// valid step directives
 	validStepDirective := map[string]RecipeStepType{
@@ -648,13 +1370,38 @@ func makeRecipe(recipeFile string, lines []LineInfo) (rec RecipeInfo) {
 		"must-not-exist-dir":  stepMustNotExistDir,
 		"must-not-exist-file": stepMustNotExistFile,
 		"script":              stepScript,
+		"if-var-set":          stepIfVarSet,
+		"if-file-exists":      stepIfFileExists,
+		"if-env":              stepIfEnv,
+		"if-os":               stepIfOs,
+		"else":                stepElse,
+		"endif":               stepEndif,
+		"foreach":             stepForeach,
+		"endforeach":          stepEndforeach,
+		"parallel":            stepParallel,
+		"endparallel":         stepEndparallel,
+	}
+
+	// step directives that do not accept data
+	noDataStepDirective := map[RecipeStepType]bool{
+		stepElse:        true,
+		stepEndif:       true,
+		stepEndforeach:  true,
+		stepEndparallel: true,
+	}
+
+	// step directives where the data is optional
+	optionalDataStepDirective := map[RecipeStepType]bool{
+		stepParallel: true,
 	}
 
 	// at this point we know that the syntax is sound so we need
 	// to parse it into the recipe data structure for execution
 	section := ""
 	re1 := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_\-0-9]*$`)
-	re2 := regexp.MustCompile(`(?s)^(\S+)\s+(\S.*)$`) // handle multiline
+	re4 := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_\-0-9]*\.[a-z]+$`) // attribute
+	re2 := regexp.MustCompile(`(?s)^(\S+)(?:\s+(\S.*))?$`)          // handle multiline
+	re3 := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_\-0-9]*\s+in(\s.*)?$`)
 	for _, li := range lines {
 		line := li.line
 		if line[0] == '[' {
@@ -663,7 +1410,11 @@ func makeRecipe(recipeFile string, lines []LineInfo) (rec RecipeInfo) {
 		}
 
 		// Get the key/value pairs.
-		key, value := getRecipeAssignmentValue(li)
+		key, value, e := getRecipeAssignmentValue(li)
+		if e != nil {
+			err = e
+			return
+		}
 
 		// Assign them.
 		switch section {
@@ -673,57 +1424,317 @@ func makeRecipe(recipeFile string, lines []LineInfo) (rec RecipeInfo) {
 				rec.Brief = value
 			case "full":
 				rec.Full = value
+			case "timeout":
+				d, e := time.ParseDuration(value)
+				if e != nil || d <= 0 {
+					err = newParseError(li, "invalid timeout '%v', expected a duration like 30s, 10m or 1h", value)
+					return
+				}
+				rec.Timeout = d
 			}
 		case "[variable]":
 			if re1.MatchString(key) {
 				rec.Variables[key] = value
+				v := rec.Decls[key] // keep the attributes if it is redeclared
+				v.Name = key
+				v.Line = li
+				kind, arg := parseVariableSource(value)
+				if e := checkVariableSource(kind, arg); e != nil {
+					err = newParseError(li, "%v", e)
+					return
+				}
+				v.Source = kind
+				rec.Decls[key] = v
+			} else if re4.MatchString(key) {
+				if err = setRecipeVariableAttribute(&rec, li, key, value); err != nil {
+					return
+				}
 			} else {
-				Log.Err("invalid variable name '%v' at line %v in %v", key, li.lineno, li.fi.abspath)
+				err = newParseError(li, "invalid variable name '%v'", key)
+				return
+			}
+		case "[step]", "[finally]", "[cleanup]":
+			// For a step we determine the modifiers and the directive, verify
+			// that they are valid and then capture the rest of the line.
+			step, value, e := getRecipeStepModifiers(li, value)
+			if e != nil {
+				err = e
+				return
 			}
-		case "[step]":
-			// For a step we determine the directive, verify that it is valid
-			// and then capture the rest of the line.
 			m := re2.FindAllStringSubmatch(value, -1)
+			if len(m) == 0 {
+				err = newParseError(li, "missing step directive")
+				return
+			}
 			directive := m[0][1]
 			value = strings.TrimSpace(m[0][2])
 			stype, ok := validStepDirective[directive]
 			if ok == false {
-				Log.Err("unknown step directive '%v' at line %v in %v", directive, li.lineno, li.fi.abspath)
+				err = newParseError(li, "unknown step directive '%v'", directive)
+				return
+			}
+			if noDataStepDirective[stype] {
+				if value != "" {
+					err = newParseError(li, "step directive '%v' does not accept arguments", directive)
+					return
+				}
+			} else if value == "" && optionalDataStepDirective[stype] == false {
+				err = newParseError(li, "missing data for step directive '%v'", directive)
+				return
+			}
+			if step.Timeout > 0 && checkRecipeStepIsBlock(stype) && stype != stepParallel {
+				err = newParseError(li, "timeout is not allowed for step directive '%v'", directive)
+				return
+			}
+			if step.Retry > 0 || step.Backoff > 0 {
+				switch stype {
+				case stepExec, stepExecNoExit, stepScript:
+					if step.Retry == 0 {
+						err = newParseError(li, "backoff requires retry")
+						return
+					}
+				default:
+					err = newParseError(li, "retry is not allowed for step directive '%v'", directive)
+					return
+				}
+			}
+			step.Directive = stype
+			step.DirectiveString = directive
+			step.Data = value
+			step.Line = li
+			if section == "[step]" {
+				rec.Steps = append(rec.Steps, step)
+			} else {
+				rec.Finally = append(rec.Finally, step)
+			}
+			if stype == stepParallel && strings.Contains(value, "${") == false {
+				// Parallel options can be checked now if there are no variables.
+				if _, _, e := parseParallelOptions(value); e != nil {
+					err = newParseError(li, "%v", e)
+					return
+				}
+			}
+			if stype == stepForeach {
+				// Foreach has a specific syntax, check it.
+				if re3.MatchString(value) == false {
+					err = newParseError(li, "foreach is of the form VAR in ITEMS")
+					return
+				}
 			}
-			rec.Steps = append(rec.Steps, RecipeStep{Directive: stype, DirectiveString: directive, Data: value, Line: li})
 			if stype == stepExport {
 				// Export has a specific syntax, check it.
 				if strings.Contains(value, "=") == false {
-					Log.Err("export is of the form VAR=VAL, could not find '=' at line %v in %v", li.lineno, li.fi.abspath)
+					err = newParseError(li, "export is of the form VAR=VAL, could not find '='")
+					return
 				}
 			}
 			break
 		default:
-			Log.Err("unknown section '%v' at line %v in %v", section, li.lineno, li.fi.abspath)
-			break
+			err = newParseError(li, "unknown section '%v'", section)
+			return
 		}
 	}
 
 	// Check the recipe to make sure that it has required fields set.
 	if len(rec.Brief) == 0 {
-		Log.Err("[description] brief not set for %v", rec.Name)
+		err = &ParseError{File: rec.File, Msg: "[description] brief not set"}
+		return
 	}
 	if len(rec.Full) == 0 {
-		Log.Err("[description] full not set for %v", rec.Name)
+		err = &ParseError{File: rec.File, Msg: "[description] full not set"}
+		return
 	}
 	if len(rec.Steps) == 0 {
-		Log.Err("no steps defined in the [step] section for %v", rec.Name)
+		err = &ParseError{File: rec.File, Msg: "no steps defined in the [step] section"}
+		return
+	}
+
+	// Match the block directives. A block cannot span sections.
+	if err = checkRecipeStepBlocks(rec.Steps); err != nil {
+		return
+	}
+	err = checkRecipeStepBlocks(rec.Finally)
+	return
+}
+
+// checkRecipeStepBlocks verifies that the block directives are properly
+// nested and sets the Match index for each one.
+func checkRecipeStepBlocks(steps []RecipeStep) (err error) {
+	stack := []int{} // indices of the open blocks
+	parallel := -1   // index of the open parallel block
+	for i, step := range steps {
+		li := step.Line
+		if parallel >= 0 {
+			// Only commands can run in a parallel block.
+			switch step.Directive {
+			case stepExec, stepExecNoExit, stepScript, stepEndparallel:
+			default:
+				err = newParseError(li, "%v is not allowed in a parallel block", step.DirectiveString)
+				return
+			}
+		}
+		switch step.Directive {
+		case stepIfVarSet, stepIfFileExists, stepIfEnv, stepIfOs:
+			stack = append(stack, i)
+		case stepElse:
+			if len(stack) == 0 || checkRecipeStepIsIf(steps[stack[len(stack)-1]]) == false {
+				err = newParseError(li, "else without a matching if")
+				return
+			}
+			steps[stack[len(stack)-1]].Match = i
+			stack[len(stack)-1] = i
+		case stepEndif:
+			if len(stack) == 0 || (checkRecipeStepIsIf(steps[stack[len(stack)-1]]) == false && steps[stack[len(stack)-1]].Directive != stepElse) {
+				err = newParseError(li, "endif without a matching if")
+				return
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			steps[top].Match = i
+
+			// The endif matches the if, not the else.
+			if steps[top].Directive == stepElse {
+				top = checkRecipeStepBlockStart(steps, top)
+			}
+			steps[i].Match = top
+		case stepForeach:
+			stack = append(stack, i)
+		case stepEndforeach:
+			if len(stack) == 0 || steps[stack[len(stack)-1]].Directive != stepForeach {
+				err = newParseError(li, "endforeach without a matching foreach")
+				return
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			steps[top].Match = i
+			steps[i].Match = top
+		case stepParallel:
+			stack = append(stack, i)
+			parallel = i
+		case stepEndparallel:
+			if parallel < 0 {
+				err = newParseError(li, "endparallel without a matching parallel")
+				return
+			}
+			stack = stack[:len(stack)-1]
+			steps[parallel].Match = i
+			steps[i].Match = parallel
+			parallel = -1
+		}
+	}
+	if len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if steps[top].Directive == stepElse {
+			top = checkRecipeStepBlockStart(steps, top)
+		}
+		li := steps[top].Line
+		err = newParseError(li, "%v block is not closed, starts", steps[top].DirectiveString)
+		return
+	}
+	return
+}
+
+// checkRecipeStepIsBlock reports whether the directive starts, continues
+// or ends a block.
+func checkRecipeStepIsBlock(stype RecipeStepType) bool {
+	switch stype {
+	case stepIfVarSet, stepIfFileExists, stepIfEnv, stepIfOs, stepElse, stepEndif:
+		return true
+	case stepForeach, stepEndforeach, stepParallel, stepEndparallel:
+		return true
+	}
+	return false
+}
+
+// checkRecipeStepIsIf reports whether the step is one of the if directives.
+func checkRecipeStepIsIf(step RecipeStep) bool {
+	switch step.Directive {
+	case stepIfVarSet, stepIfFileExists, stepIfEnv, stepIfOs:
+		return true
+	}
+	return false
+}
+
+// checkRecipeStepBlockStart finds the if that an else belongs to.
+func checkRecipeStepBlockStart(steps []RecipeStep, e int) int {
+	for i := e - 1; i >= 0; i-- {
+		if steps[i].Match == e {
+			return i
+		}
+	}
+	return e
+}
+
+// getRecipeStepModifiers strips the modifiers from the front of a step
+// value and returns them in a step along with the rest of the value.
+// Modifiers have the form <name>=<value>:
+//     timeout=DURATION    Kill the step if it runs longer than DURATION.
+//     retry=N             Re-run a failed command up to N times.
+//     backoff=DURATION    Delay before the first retry, it doubles for
+//                         each subsequent retry.
+func getRecipeStepModifiers(li LineInfo, value string) (step RecipeStep, rest string, err error) {
+	re := regexp.MustCompile(`(?s)^([a-z]+)=(\S+)\s+(.*)$`)
+	rest = value
+	for {
+		m := re.FindStringSubmatch(rest)
+		if m == nil {
+			break
+		}
+		switch m[1] {
+		case "timeout":
+			d, e := time.ParseDuration(m[2])
+			if e != nil || d <= 0 {
+				err = newParseError(li, "invalid timeout '%v', expected a duration like 30s, 10m or 1h", m[2])
+				return
+			}
+			step.Timeout = d
+		case "retry":
+			n, e := strconv.Atoi(m[2])
+			if e != nil || n < 0 {
+				err = newParseError(li, "invalid retry '%v', expected a non-negative integer", m[2])
+				return
+			}
+			step.Retry = n
+		case "backoff":
+			d, e := time.ParseDuration(m[2])
+			if e != nil || d < 0 {
+				err = newParseError(li, "invalid backoff '%v', expected a duration like 500ms, 5s or 1m", m[2])
+				return
+			}
+			step.Backoff = d
+		default:
+			err = newParseError(li, "unknown step modifier '%v'", m[1])
+			return
+		}
+		rest = strings.TrimSpace(m[3])
+	}
+	return
+}
+
+// getRecipeStepModifierString returns the modifiers for a step in the
+// form that they are declared in.
+func getRecipeStepModifierString(step RecipeStep) (s string) {
+	if step.Timeout > 0 {
+		s += fmt.Sprintf("timeout=%v ", step.Timeout)
+	}
+	if step.Retry > 0 {
+		s += fmt.Sprintf("retry=%v ", step.Retry)
+	}
+	if step.Backoff > 0 {
+		s += fmt.Sprintf("backoff=%v ", step.Backoff)
 	}
 	return
 }
 
 // getRecipeAssignmentValue gets the value associated with an assignment.
 // This can be tricky for multiline strings for full and scripts.
-func getRecipeAssignmentValue(li LineInfo) (key string, value string) {
+func getRecipeAssignmentValue(li LineInfo) (key string, value string, err error) {
 	line := li.line
-	re1 := regexp.MustCompile(`(?s)^\s*script\s+"""(.*)+"""$`)
-	re2 := regexp.MustCompile(`(?s)^\s*info\s+"""(.*)+"""$`)
-	re3 := regexp.MustCompile(`(?s)^\s*info\s+"`)
+	// The script and info directives can be preceded by step modifiers
+	// like timeout=10s.
+	re1 := regexp.MustCompile(`(?s)^\s*((?:[a-z]+=\S+\s+)*)script\s+"""(.*)+"""$`)
+	re2 := regexp.MustCompile(`(?s)^\s*((?:[a-z]+=\S+\s+)*)info\s+"""(.*)+"""$`)
+	re3 := regexp.MustCompile(`(?s)^\s*((?:[a-z]+=\S+\s+)*)info\s+"`)
 
 	// Get the key/value pairs.
 	tokens := strings.SplitN(line, "=", 2)
@@ -740,7 +1751,8 @@ func getRecipeAssignmentValue(li LineInfo) (key string, value string) {
 		var e error
 		value, e = strconv.Unquote(value)
 		if e != nil {
-			Log.Err("internal error, unquote operation failed at line %v in %v", li.lineno, li.fi.abspath)
+			err = newParseError(li, "internal error, unquote operation failed")
+			return
 		}
 	} else if re1.MatchString(value) {
 		// Handle lines of the form:
@@ -748,7 +1760,7 @@ func getRecipeAssignmentValue(li LineInfo) (key string, value string) {
 		//   """
 		m := re1.FindAllStringSubmatch(value, -1)
 		if len(m) > 0 {
-			value = "script " + strings.TrimSpace(m[0][1])
+			value = m[0][1] + "script " + strings.TrimSpace(m[0][2])
 		}
 	} else if re2.MatchString(value) {
 		// Handle lines of the form:
@@ -757,43 +1769,48 @@ func getRecipeAssignmentValue(li LineInfo) (key string, value string) {
 		//   """
 		m := re2.FindAllStringSubmatch(value, -1)
 		if len(m) > 0 {
-			value = "info " + strings.TrimSpace(m[0][1])
+			value = m[0][1] + "info " + strings.TrimSpace(m[0][2])
 		}
 	} else if re3.MatchString(value) {
 		// Handle lines of the form:
 		//   step = info "this is a test"  --> this is a test
+		m := re3.FindAllStringSubmatch(value, -1)
 		p := strings.Index(value, `"`)
 		s := value[p:]
 		u, e := strconv.Unquote(s)
 		if e != nil {
-			Log.Err("internal error, unquote operation failed at line %v in %v", li.lineno, li.fi.abspath)
+			err = newParseError(li, "internal error, unquote operation failed")
+			return
 		}
-		value = "info " + u
+		value = m[0][1] + "info " + u
 	}
 	return
 }
 
 // getRecipeName gets the recipe name
-func getRecipeName(recipeFile string) (name string, abspath string) {
+func getRecipeName(recipeFile string) (name string, abspath string, err error) {
 	// Get the name.
 	fn := filepath.Base(recipeFile)
 	ext := filepath.Ext(fn)
 	name = fn[:len(fn)-len(ext)]
 	a, err := filepath.Abs(recipeFile)
 	if err != nil {
-		Log.Err("invalid file path: %v", err)
+		err = fmt.Errorf("invalid file path: %v", err)
+		return
 	}
 	abspath = a
 	return
 }
 
 // checkValidSections
-func checkValidSections(recipeFile string, lines []LineInfo) {
+func checkValidSections(recipeFile string, lines []LineInfo) (err error) {
 	// valid sections and decl keywords within the section
 	validSections := map[string]map[string]int{
-		"[description]": {"brief": 0, "full": 0},
+		"[description]": {"brief": 0, "full": 0, "timeout": 0},
 		"[variable]":    {},
-		"[step]":        {"step": 0}}
+		"[step]":        {"step": 0},
+		"[finally]":     {"step": 0},
+		"[cleanup]":     {"step": 0}}
 
 	// Verify that no statements exist outside of a section.
 	section := ""
@@ -802,7 +1819,8 @@ func checkValidSections(recipeFile string, lines []LineInfo) {
 		if line[0] == '[' {
 			// This is a section, see if it is a valid one.
 			if _, ok := validSections[line]; ok == false {
-				Log.Err("invalid section found: %v at line %v in %v", line, li.lineno, li.fi.abspath)
+				err = newParseError(li, "invalid section found: %v", line)
+				return
 			}
 			section = line
 			continue
@@ -810,12 +1828,14 @@ func checkValidSections(recipeFile string, lines []LineInfo) {
 
 		// All statements must be inside a section, check for orphans.
 		if section == "" {
-			Log.Err("orphan declaration at line %v in %v: %v", li.lineno, li.fi.abspath, li.line)
+			err = newParseError(li, "orphan declaration '%v'", li.line)
+			return
 		}
 
 		// Check for an equals sign.
 		if strings.Contains(line, "=") == false {
-			Log.Err("syntax error, missing '=' at line %v in %v: %v", li.lineno, li.fi.abspath, li.line)
+			err = newParseError(li, "syntax error, missing '=' in '%v'", li.line)
+			return
 		}
 
 		// Make sure that the tokens are valid.
@@ -823,9 +1843,11 @@ func checkValidSections(recipeFile string, lines []LineInfo) {
 		decl := strings.TrimSpace(tokens[0])
 		if section != "[variable]" {
 			if _, ok := validSections[section][decl]; ok == false {
-				Log.Err("syntax error, found invalid declaration '%v' in section '%v' at line %v in %d: %v", decl, section, li.lineno, li.fi.abspath, li.line)
+				err = newParseError(li, "syntax error, found invalid declaration '%v' in section '%v'", decl, section)
+				return
 			}
 			validSections[section][decl] = 1
 		}
 	}
+	return
 }
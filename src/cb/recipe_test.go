@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Context.Base = "cb"
+	Log.InfoEnabled = false
+	Log.WarningEnabled = false
+	os.Exit(m.Run())
+}
+
+// testLoadRecipe writes a recipe to a temporary file and loads it.
+func testLoadRecipe(t *testing.T, text string) RecipeInfo {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "test.ini")
+	if err := os.WriteFile(fn, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := loadRecipe(fn)
+	if err != nil {
+		t.Fatalf("loadRecipe: %v", err)
+	}
+	return recipe
+}
+
+// testRunRecipe runs the steps of a recipe with the arguments and returns
+// the output.
+func testRunRecipe(t *testing.T, recipe RecipeInfo, args ...string) (string, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := Log.Writers
+	Log.Writers = []io.Writer{&buf}
+	defer func() { Log.Writers = saved }()
+	opts := CliOptions{ExtraArgs: args}
+	if err := runRecipeInitVariables(&recipe, opts); err != nil {
+		return buf.String(), err
+	}
+	err := runRecipeSteps(context.Background(), opts, &recipe, recipe.Steps, "step")
+	return buf.String(), err
+}
+
+func TestExecStepArgs(t *testing.T) {
+	recipe := testLoadRecipe(t, `[description]
+brief = args
+full = args
+
+[step]
+step = exec printf "[%s]\n" ${CB_ARGS}
+`)
+	out, err := testRunRecipe(t, recipe, "--", "hello world", "it's", `a"b`, "$HOME")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[hello world]\n[it's]\n[a\"b]\n[$HOME]\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestExecStepArgsInherited(t *testing.T) {
+	// A recipe that is run by a step inherits an empty CB_ARGS.
+	os.Setenv("CB_ARGS", "")
+	defer os.Unsetenv("CB_ARGS")
+	recipe := testLoadRecipe(t, `[description]
+brief = args
+full = args
+
+[step]
+step = exec echo ok ${CB_ARGS}
+`)
+	out, err := testRunRecipe(t, recipe)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "ok\n" {
+		t.Errorf("got %q, want %q", out, "ok\n")
+	}
+}
+
+func TestFinallyStatus(t *testing.T) {
+	tests := []struct {
+		step string
+		want string
+	}{
+		{"exec true", "passed"},
+		{"exec false", "failed"},
+		{"timeout=100ms exec sleep 5", "timeout"},
+	}
+	for _, tt := range tests {
+		recipe := testLoadRecipe(t, `[description]
+brief = status
+full = status
+
+[step]
+step = `+tt.step+`
+
+[finally]
+step = exec echo ${CB_STATUS}
+`)
+		var buf bytes.Buffer
+		saved := Log.Writers
+		Log.Writers = []io.Writer{&buf}
+		err := runRecipe(CliOptions{Recipe: recipe.File})
+		Log.Writers = saved
+		if (err != nil) != (tt.want != "passed") {
+			t.Errorf("%v: unexpected error: %v", tt.step, err)
+		}
+		if got := buf.String(); got != tt.want+"\n" {
+			t.Errorf("%v: CB_STATUS = %q, want %q", tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestDryrunForeach(t *testing.T) {
+	recipe := testLoadRecipe(t, `[description]
+brief = foreach
+full = foreach
+
+[variable]
+items = a b
+
+[step]
+step = foreach it in ${items}
+step = exec echo item-${it}
+step = endforeach
+step = foreach it in
+step = exec echo empty-${it}
+step = endforeach
+`)
+	var buf bytes.Buffer
+	saved := Log.Writers
+	Log.Writers = []io.Writer{&buf}
+	defer func() { Log.Writers = saved }()
+	if err := runRecipeInitVariables(&recipe, CliOptions{Dryrun: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	runRecipeDryrun(recipe)
+	out := buf.String()
+	for _, s := range []string{"data      : echo item-a\n", "data      : echo item-b\n", "iteration : 2 of 2 (it = b)\n"} {
+		if strings.Contains(out, s) == false {
+			t.Errorf("dry run does not contain %q:\n%v", s, out)
+		}
+	}
+	for _, s := range []string{"${it}", "empty-"} {
+		if strings.Contains(out, s) {
+			t.Errorf("dry run contains %q:\n%v", s, out)
+		}
+	}
+	if _, ok := recipe.Variables["it"]; ok {
+		t.Errorf("the loop variable was not removed")
+	}
+}
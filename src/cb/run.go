@@ -2,8 +2,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"time"
 
 	"github.com/jlinoff/go/run"
@@ -45,62 +48,53 @@ func RunSilentOpt(opts []string) {
 	return
 }
 
-// RunCmd runs a command with logging.
-// It exits if an error occurred.
-// It is a wrapper for runCmd.
-func RunCmd(f string, a ...interface{}) (err error) {
+// RunCmdWithContext runs a command with logging.
+// The command is killed if the context is done before it finishes.
+// It does not exit if an error occurred, the caller decides what to do.
+func RunCmdWithContext(ctx context.Context, f string, a ...interface{}) (err error) {
 	cmd := fmt.Sprintf(f, a...)
 	wd, _ := os.Getwd()
 	Log.InfoWithLevel(3, "cmd.cmd = %v", cmd)
 	Log.InfoWithLevel(3, "cmd.pwd = %v", wd)
 	s := time.Now()
-	err = run.CmdWithWriters(TokenizeString(cmd), Log.Writers)
+	err = RunCmdContext(ctx, Log.Writers, "%v", cmd)
 	Log.InfoWithLevel(3, "cmd.elapsed = %.03f", time.Since(s).Seconds())
 	if err == nil {
 		Log.InfoWithLevel(3, "cmd.status = passed")
 	} else {
 		code := run.GetExitCode(err)
-		Log.ErrWithLevel(3, "cmd.status = failed (%v) - %v", code, err)
+		Log.InfoWithLevel(3, "cmd.status = failed (%v) - %v", code, err)
 	}
 	return
 }
 
-// RunCmdNoExit runs a command with logging.
-// It does not exit if an error occurred.
-// It is a wrapper for runCmd.
-func RunCmdNoExit(f string, a ...interface{}) (err error) {
-	cmd := fmt.Sprintf(f, a...)
-	wd, _ := os.Getwd()
-	Log.InfoWithLevel(3, "cmd.cmd = %v", cmd)
-	Log.InfoWithLevel(3, "cmd.pwd = %v", wd)
-	s := time.Now()
-	err = run.CmdWithWriters(TokenizeString(cmd), Log.Writers)
-	Log.InfoWithLevel(3, "cmd.elapsed = %.03f", time.Since(s).Seconds())
-	if err == nil {
-		Log.InfoWithLevel(3, "cmd.status = passed")
-	} else {
-		code := run.GetExitCode(err)
-		Log.WarnWithLevel(3, "cmd.status = failed (%v) - %v", code, err)
+// RunCmdContext runs a command with the output written to the writers.
+// It does not log anything so it is safe to call from multiple goroutines.
+// The command runs in its own process group so that the command and all of
+// its children are killed if the context is cancelled before it finishes.
+func RunCmdContext(ctx context.Context, writers []io.Writer, f string, a ...interface{}) (err error) {
+	tokens := TokenizeString(fmt.Sprintf(f, a...))
+	if len(tokens) == 0 {
+		return fmt.Errorf("empty command")
 	}
-	return
-}
-
-// RunCmdSilent runs a command with logging.
-// It exits if an error occurred.
-// It is a wrapper for runCmd.
-func RunCmdSilent(f string, a ...interface{}) (out string, err error) {
-	cmd := fmt.Sprintf(f, a...)
-	wd, _ := os.Getwd()
-	Log.InfoWithLevel(3, "cmd.cmd = %v", cmd)
-	Log.InfoWithLevel(3, "cmd.pwd = %v", wd)
-	s := time.Now()
-	out, err = run.CmdSilent(TokenizeString(cmd))
-	Log.InfoWithLevel(3, "cmd.elapsed = %.03f", time.Since(s).Seconds())
-	if err == nil {
-		Log.InfoWithLevel(3, "cmd.status = passed")
-	} else {
-		code := run.GetExitCode(err)
-		Log.ErrWithLevel(3, "cmd.status = failed (%v) - %v", code, err)
+	w := io.MultiWriter(writers...)
+	cmd := exec.Command(tokens[0], tokens[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	setProcessGroup(cmd)
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = ctx.Err()
 	}
 	return
 }
@@ -0,0 +1,261 @@
+// Search the recipes.
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// searchField is a recipe field that is searched. The weight is the score
+// for a match in the field, a match in the name is worth more than a match
+// in a step.
+type searchField struct {
+	label  string
+	text   string
+	weight int
+}
+
+// searchTerm is a search term with the case insensitive patterns for the
+// term and its stems, longest first. The patterns match the original text
+// because changing the case can change the length of the text.
+type searchTerm struct {
+	text  string
+	stems []*regexp.Regexp
+}
+
+// newSearchTerms compiles the search terms.
+func newSearchTerms(terms []string) (sts []searchTerm) {
+	for _, term := range terms {
+		st := searchTerm{text: term}
+		for _, stem := range searchStems(strings.ToLower(term)) {
+			st.stems = append(st.stems, regexp.MustCompile("(?i)"+regexp.QuoteMeta(stem)))
+		}
+		sts = append(sts, st)
+	}
+	return
+}
+
+// searchResult is a recipe that matched.
+type searchResult struct {
+	recipe   RecipeInfo
+	terms    int      // number of terms that matched
+	score    int      // sum of the field weights for each match
+	snippets []string // the matches with some context
+}
+
+// searchRecipes searches the recipe names, descriptions, variable names
+// and steps for the terms and reports the recipes that matched, best
+// match first. A term matches if it, or its stem, is a substring of a
+// field or, for the name, if its letters appear in order, so "dpstg"
+// matches "deploy-staging". Recipes that match more terms rank higher.
+func searchRecipes(terms []string) error {
+	if len(terms) == 0 {
+		return &UsageError{Msg: "missing search terms, try: search <terms>"}
+	}
+	recipes, err := loadAllRecipes()
+	if err != nil {
+		return err
+	}
+
+	sts := newSearchTerms(terms)
+	results := []searchResult{}
+	for _, recipe := range recipes {
+		if recipe.Shadowed {
+			continue // it cannot be run
+		}
+		if r := searchRecipe(recipe, sts); r.terms > 0 {
+			results = append(results, r)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].terms != results[j].terms {
+			return results[i].terms > results[j].terms
+		}
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].recipe.Name < results[j].recipe.Name
+	})
+
+	if len(results) == 0 {
+		Log.Warn("no recipes matched %v", terms)
+		return nil
+	}
+	hl := searchHighlighter()
+	for i, r := range results {
+		if i > 0 {
+			fmt.Printf("\n")
+		}
+		fmt.Printf("%v - %v  [%v]\n", hl(r.recipe.Name, sts), hl(r.recipe.Brief, sts), r.recipe.Dir)
+		for _, s := range r.snippets {
+			fmt.Printf("    %v\n", hl(s, sts))
+		}
+	}
+	return nil
+}
+
+// searchRecipe scores a recipe.
+func searchRecipe(recipe RecipeInfo, terms []searchTerm) (r searchResult) {
+	r.recipe = recipe
+	fields := []searchField{
+		{"name", recipe.Name, 10},
+		{"brief", recipe.Brief, 5},
+	}
+	vs := []string{}
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	for k := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) == false {
+			vs = append(vs, k)
+		}
+	}
+	sort.Strings(vs)
+	fields = append(fields, searchField{"variables", strings.Join(vs, " "), 3})
+	fields = append(fields, searchField{"full", recipe.Full, 2})
+	for _, step := range append(recipe.Steps, recipe.Finally...) {
+		fields = append(fields, searchField{"step", step.DirectiveString + " " + step.Data, 1})
+	}
+
+	seen := map[string]bool{} // only report a snippet once
+	for _, term := range terms {
+		matched := false
+		for _, field := range fields {
+			p, n := searchMatch(field.text, term)
+			if p < 0 {
+				continue
+			}
+			matched = true
+			r.score += field.weight
+			if field.label == "name" || field.label == "brief" {
+				continue // always displayed
+			}
+			s := fmt.Sprintf("%-9v: %v", field.label, searchSnippet(field.text, p, n))
+			if seen[s] == false && len(r.snippets) < 3 {
+				seen[s] = true
+				r.snippets = append(r.snippets, s)
+			}
+		}
+		if matched == false && searchFuzzy(recipe.Name, term.text) {
+			matched = true
+			r.score += 4
+		}
+		if matched {
+			r.terms++
+		}
+	}
+	return
+}
+
+// searchMatch finds the term, or its stem, in the text ignoring case. It
+// returns the position and length of the match in the text or -1.
+func searchMatch(text string, term searchTerm) (int, int) {
+	for _, re := range term.stems {
+		if loc := re.FindStringIndex(text); loc != nil {
+			return loc[0], loc[1] - loc[0]
+		}
+	}
+	return -1, 0
+}
+
+// searchStems returns the term and its stems, longest first, so that
+// "deploys" and "deploying" match "deploy".
+func searchStems(term string) []string {
+	stems := []string{term}
+	for _, suffix := range []string{"ing", "es", "ed", "s"} {
+		if strings.HasSuffix(term, suffix) && len(term)-len(suffix) >= 3 {
+			stems = append(stems, term[:len(term)-len(suffix)])
+		}
+	}
+	return stems
+}
+
+// searchFuzzy reports whether the letters of the term appear in order in
+// the text, ignoring case.
+func searchFuzzy(text string, term string) bool {
+	lt := strings.ToLower(text)
+	i := 0
+	for _, ch := range strings.ToLower(term) {
+		p := strings.IndexRune(lt[i:], ch)
+		if p < 0 {
+			return false
+		}
+		i += p + len(string(ch))
+	}
+	return true
+}
+
+// searchSnippet returns the line that contains the match, shortened to
+// about 60 characters around the match.
+func searchSnippet(text string, p int, n int) string {
+	start := strings.LastIndex(text[:p], "\n") + 1
+	end := strings.Index(text[p:], "\n")
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += p
+	}
+	prefix, suffix := "", ""
+	if p-start > 30 {
+		start = p - 30
+		for utf8.RuneStart(text[start]) == false {
+			start++ // do not split a character
+		}
+		prefix = "..."
+	}
+	if end-(p+n) > 30 {
+		end = p + n + 30
+		for utf8.RuneStart(text[end]) == false {
+			end--
+		}
+		suffix = "..."
+	}
+	return prefix + strings.TrimSpace(text[start:end]) + suffix
+}
+
+// searchHighlighter returns a function that highlights the terms in a
+// string. The terms are shown in bold if stdout is a terminal and the
+// NO_COLOR environment variable is not set, otherwise they are not
+// highlighted so that the output can be piped.
+func searchHighlighter() func(string, []searchTerm) string {
+	fi, err := os.Stdout.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 || os.Getenv("NO_COLOR") != "" {
+		return func(s string, terms []searchTerm) string {
+			return s
+		}
+	}
+	return searchHighlight
+}
+
+// searchHighlight highlights all of the matches of the terms in a string.
+// The matches are found first and the escape sequences are added in a
+// single pass so that a term cannot match an escape sequence.
+func searchHighlight(s string, terms []searchTerm) string {
+	marks := make([]bool, len(s)+1) // the bytes that are highlighted
+	for _, term := range terms {
+		for _, re := range term.stems {
+			locs := re.FindAllStringIndex(s, -1)
+			for _, loc := range locs {
+				for i := loc[0]; i < loc[1]; i++ {
+					marks[i] = true
+				}
+			}
+			if len(locs) > 0 {
+				break
+			}
+		}
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if marks[i] && (i == 0 || marks[i-1] == false) {
+			buf.WriteString("\033[1;31m")
+		}
+		buf.WriteByte(s[i])
+		if marks[i] && marks[i+1] == false {
+			buf.WriteString("\033[0m")
+		}
+	}
+	return buf.String()
+}
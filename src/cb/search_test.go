@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSearchMatch(t *testing.T) {
+	tests := []struct {
+		text string
+		term string
+		want string // the matched text, empty if there is no match
+	}{
+		{"Deploy the app", "deploy", "Deploy"},
+		{"deploying the app", "deploys", "deploy"},
+		{"ȺȺȺȺ deploy staging", "staging", "staging"}, // Ⱥ is longer in lower case
+		{"ȺȺȺȺ deploy staging", "ⱥⱥ", "ȺȺ"},
+		{"Straße", "STRASSE", ""},
+		{"nothing here", "deploy", ""},
+	}
+	for _, tt := range tests {
+		p, n := searchMatch(tt.text, newSearchTerms([]string{tt.term})[0])
+		got := ""
+		if p >= 0 {
+			got = tt.text[p : p+n]
+		}
+		if got != tt.want {
+			t.Errorf("searchMatch(%q, %q) = %q, want %q", tt.text, tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	text := strings.Repeat("ȺéȺ ", 20) + "déploy" + strings.Repeat(" ȺéȺ", 20)
+	for _, term := range []string{"déploy", "DÉPLOY"} {
+		p, n := searchMatch(text, newSearchTerms([]string{term})[0])
+		s := searchSnippet(text, p, n)
+		if utf8.ValidString(s) == false {
+			t.Errorf("searchSnippet for %q is not valid UTF-8: %q", term, s)
+		}
+		if strings.HasPrefix(s, "...") == false || strings.HasSuffix(s, "...") == false {
+			t.Errorf("searchSnippet for %q was not shortened: %q", term, s)
+		}
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	const on, off = "\033[1;31m", "\033[0m"
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"deploy staging", []string{"deploy"}, on + "deploy" + off + " staging"},
+		{"Ⱥ deploy Ⱥ", []string{"ⱥ"}, on + "Ⱥ" + off + " deploy " + on + "Ⱥ" + off},
+		{"m3 m3", []string{"m", "3"}, on + "m3" + off + " " + on + "m3" + off},
+		{"make", []string{"ma", "ak"}, on + "mak" + off + "e"},
+	}
+	for _, tt := range tests {
+		got := searchHighlight(tt.text, newSearchTerms(tt.terms))
+		if got != tt.want {
+			t.Errorf("searchHighlight(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
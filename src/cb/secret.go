@@ -0,0 +1,164 @@
+// Secret recipe variables.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretMask replaces the value of a secret variable in the output.
+const secretMask = "****"
+
+// secrets are the values and the names of the secret variables. They are
+// masked in everything that Log writes. The mutex is needed because the
+// parallel steps write to the log from their own goroutines.
+var secrets = struct {
+	sync.RWMutex
+	values []string       // longest first so that a value that contains another is masked
+	export *regexp.Regexp // matches the ###export lines for the secret variables
+}{}
+
+// addSecrets records the values of the secret variables of a recipe so
+// that they are masked. It is called again when the values change.
+func addSecrets(recipe RecipeInfo) {
+	names := []string{}
+	for k, d := range recipe.Decls {
+		if d.Secret {
+			names = append(names, regexp.QuoteMeta(k))
+			addSecretValue(recipe.Variables[k])
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		re := regexp.MustCompile(`(###export\s+(?:` + strings.Join(names, "|") + `)\s*=\s*)\S.*`)
+		secrets.Lock()
+		secrets.export = re
+		secrets.Unlock()
+	}
+}
+
+// addSecretValue records a secret value so that it is masked. Empty
+// values are ignored.
+func addSecretValue(value string) {
+	if value == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+	sort.SliceStable(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// maskSecrets replaces the secret values in a string by the mask. The
+// values in ###export lines for secret variables are masked too because
+// they are written before the new value is known.
+func maskSecrets(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, v := range secrets.values {
+		s = strings.Replace(s, v, secretMask, -1)
+	}
+	if secrets.export != nil {
+		s = secrets.export.ReplaceAllString(s, "${1}"+secretMask)
+	}
+	return s
+}
+
+// secretWriter masks the secret values in the output of a writer. A value
+// that is split across two writes is not masked, that does not happen for
+// the log messages because each one is written at once.
+type secretWriter struct {
+	w io.Writer
+}
+
+// Write writes the masked data.
+func (s secretWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, maskSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// maskLogWriters wraps the log writers so that the secret values are
+// masked on the terminal and in the tee file. The writers that capture
+// the step output for ###export are pushed later and they are not masked.
+func maskLogWriters() {
+	for i, w := range Log.Writers {
+		if _, ok := w.(secretWriter); ok == false {
+			Log.Writers[i] = secretWriter{w: w}
+		}
+	}
+}
+
+// addOptionSecrets masks the values of the secret options on the command
+// line before the context, that includes the command, is reported. The
+// recipe is loaded quietly to find the secret variables, the errors are
+// reported when it is run.
+func addOptionSecrets(opts CliOptions) {
+	info, warn := Log.InfoEnabled, Log.WarningEnabled
+	Log.InfoEnabled, Log.WarningEnabled = false, false
+	recipe, err := loadRecipe(opts.Recipe)
+	Log.InfoEnabled, Log.WarningEnabled = info, warn
+	if err != nil {
+		return
+	}
+	secret := map[string]bool{}
+	for k, d := range recipe.Decls {
+		if d.Secret {
+			secret["--"+k] = true
+			if d.Short != "" {
+				secret["-"+d.Short] = true
+			}
+		}
+	}
+	for i := 0; i < len(opts.ExtraArgs) && opts.ExtraArgs[i] != "--"; i++ {
+		opt := opts.ExtraArgs[i]
+		if p := strings.Index(opt, "="); p > 0 && secret[opt[:p]] {
+			addSecretValue(opt[p+1:])
+		} else if secret[opt] && i+1 < len(opts.ExtraArgs) {
+			i++
+			addSecretValue(opts.ExtraArgs[i])
+		}
+	}
+	maskLogWriters()
+}
+
+// promptSecret prompts for the value of a secret variable without echoing
+// it. It returns false if stdin is not a terminal, stty fails for a
+// device like /dev/null that is not a terminal.
+func promptSecret(name string) (string, bool, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return "", false, nil
+	}
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") != nil {
+		return "", false, nil
+	}
+	defer stty("echo")
+	fmt.Fprintf(os.Stderr, "%v: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	return strings.TrimRight(line, "\r\n"), true, nil
+}
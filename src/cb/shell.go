@@ -0,0 +1,705 @@
+// Compile a recipe into a standalone bash script.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runRecipeShellScript generates a bash script that is equivalent to the
+// recipe so that it can be run on machines that do not have cb installed.
+func runRecipeShellScript(opts CliOptions) (err error) {
+	Log.Info("generating shell script for recipe %v to %v", opts.Recipe, opts.ShellScript)
+
+	// We need to load the recipe to get the variable names.
+	recipe, err := loadRecipe(opts.Recipe)
+	if err != nil {
+		return
+	}
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+
+	// Separate the recipe variables from the built-in environment variables.
+	rvs := map[string]string{}
+	evs := []string{}
+	for k, v := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) {
+			evs = append(evs, k)
+		} else {
+			rvs[k] = v
+		}
+	}
+	sort.Strings(evs)
+
+	var buf bytes.Buffer
+	w := func(f string, a ...interface{}) {
+		fmt.Fprintf(&buf, f, a...)
+	}
+
+	// Header.
+	w("#!/bin/bash\n")
+	w("#\n")
+	w("# Recipe: %v\n", recipe.Name)
+	w("# File  : %v\n", recipe.File)
+	w("# Brief : %v\n", recipe.Brief)
+	w("#\n")
+	w("# Generated by %v v%v on %v.\n", Context.Base, Context.MakeVersion, time.Now().Format("2006-01-02 15:04:05"))
+	w("#\n")
+	w("set -e\n")
+	w("set -o pipefail\n")
+	w("set -f # %v does not expand file name patterns\n", Context.Base)
+	w("\n")
+	w("cb_die() {\n")
+	w("    echo \"ERROR: $*\" >&2\n")
+	w("    exit 1\n")
+	w("}\n")
+	w("\n")
+	w("cb_usage() {\n")
+	w("    cat <<'CB_USAGE_EOF'\n")
+	w("%v\n", recipe.Full)
+	if o := recipeOptionsHelp(recipe); o != "" {
+		w("%v\n", o)
+	}
+	w("CB_USAGE_EOF\n")
+	w("}\n")
+	w("\n")
+	w("# Update variables from script output lines of the form:\n")
+	w("#     ###export <variable> = <value>\n")
+	w("cb_exports() {\n")
+	w("    local line key val\n")
+	w("    while IFS= read -r line ; do\n")
+	w("        key=\"${line%%%%=*}\"\n")
+	w("        val=\"${line#*=}\"\n")
+	w("        val=\"${val%%\"${val##*[![:space:]]}\"}\"\n")
+	w("        if [[ \"${val}\" == \\\"*\\\" ]] ; then\n")
+	w("            val=\"${val:1:${#val}-2}\"\n")
+	w("        fi\n")
+	w("        printf -v \"cb_${key//-/_}\" '%%s' \"${val}\"\n")
+	w("    done < <(sed -n -E 's/^[[:space:]]*###export[[:space:]]+([a-z0-9_-]+)[[:space:]]*=[[:space:]]*(.*)$/\\1=\\2/p' \"$1\")\n")
+	w("}\n")
+	w("\n")
+	w("# Run the command for an exec step and update the variables from its\n")
+	w("# output, even if it fails.\n")
+	w("cb_run() {\n")
+	w("    local out rc=0\n")
+	w("    out=\"$(mktemp)\"\n")
+	w("    \"$@\" | tee \"${out}\" || rc=$?\n")
+	w("    cb_exports \"${out}\"\n")
+	w("    rm -f \"${out}\"\n")
+	w("    return ${rc}\n")
+	w("}\n")
+	w("\n")
+	w("# Set %vARGS to the pass through arguments quoted the same way\n", prefix)
+	w("# that %v quotes them.\n", Context.Base)
+	w("cb_quote_args() {\n")
+	w("    local arg sq=\"'\" esc=\"'\\\\''\" args=()\n")
+	w("    for arg in \"$@\" ; do\n")
+	w("        if [[ \"${arg}\" =~ ^[a-zA-Z0-9_@%%+=:,./-]+$ ]] ; then\n")
+	w("            args+=(\"${arg}\")\n")
+	w("        else\n")
+	w("            args+=(\"'${arg//${sq}/${esc}}'\")\n")
+	w("        fi\n")
+	w("    done\n")
+	w("    %vARGS=\"${args[*]}\"\n", prefix)
+	w("}\n")
+	w("\n")
+	w("# Run a command, re-run it up to $1 times if it fails.\n")
+	w("# The delay before the first retry is $2 seconds, it doubles after each one.\n")
+	w("cb_retry() {\n")
+	w("    local tries=\"$1\" delay=\"$2\" attempt=1 rc\n")
+	w("    shift 2\n")
+	w("    while true ; do\n")
+	w("        rc=0\n")
+	w("        \"$@\" || rc=$?\n")
+	w("        [ ${rc} -ne 0 ] || return 0\n")
+	w("        [ ${attempt} -le ${tries} ] || return ${rc}\n")
+	w("        echo \"WARNING: attempt ${attempt} failed (${rc}), retrying in ${delay}s\" >&2\n")
+	w("        sleep \"${delay}\"\n")
+	w("        delay=$(awk \"BEGIN { print ${delay} * 2 }\")\n")
+	w("        attempt=$((attempt + 1))\n")
+	w("    done\n")
+	w("}\n")
+	w("\n")
+	w("# Wait until fewer than $1 background jobs are running.\n")
+	w("cb_parallel_wait() {\n")
+	w("    while [ \"$(jobs -pr | wc -l)\" -ge \"$1\" ] ; do\n")
+	w("        sleep 0.1\n")
+	w("    done\n")
+	w("}\n")
+
+	// Built-in environment variables. The run specific ones are computed
+	// when the script runs, the others are captured now.
+	dynamic := map[string]string{
+		prefix + "PID":       "$$",
+		prefix + "PWD":       "$(pwd)",
+		prefix + "TIMESTAMP": "$(date +%Y%m%d-%H%M%S)",
+		prefix + "USERNAME":  "$(id -un)",
+		prefix + "SCRIPTS":   fmt.Sprintf("${HOME}/.%v", Context.Base),
+	}
+	if len(evs) > 0 {
+		w("\n")
+		w("# Built-in environment variables.\n")
+		for _, k := range evs {
+			v, ok := dynamic[k]
+			if ok {
+				v = "\"" + v + "\""
+			} else {
+				v = shellQuoteLiteral(recipe.Variables[k])
+			}
+			w("[ -n \"${%v}\" ] || %v=%v\n", k, k, v)
+			w("export %v\n", k)
+		}
+	}
+
+	// Recipe variables and command line parsing.
+	rks := []string{}
+	for k := range rvs {
+		rks = append(rks, k)
+	}
+	sort.Strings(rks)
+	w("\n")
+	w("# Recipe variables.\n")
+	for _, k := range rks {
+		w("unset %v\n", shellVarName(k))
+	}
+	w("%vARGS=''\n", prefix)
+	w("cb_args=()\n")
+	w("while [ $# -gt 0 ] ; do\n")
+	w("    case \"$1\" in\n")
+	w("        -h|--help)\n")
+	w("            cb_usage\n")
+	w("            exit 0\n")
+	w("            ;;\n")
+	w("        --)\n")
+	w("            shift\n")
+	w("            cb_args=(\"$@\")\n")
+	w("            cb_quote_args \"$@\"\n")
+	w("            break\n")
+	w("            ;;\n")
+	for _, k := range rks {
+		d := recipe.Decls[k]
+		opt := "--" + k
+		if d.Short != "" {
+			opt = "-" + d.Short + "|" + opt
+		}
+		set := func(v string) string {
+			if d.List {
+				// the values accumulate
+				return fmt.Sprintf("%v=\"${%v:+${%v} }%v\"", shellVarName(k), shellVarName(k), shellVarName(k), v)
+			}
+			return fmt.Sprintf("%v=\"%v\"", shellVarName(k), v)
+		}
+		if d.Type.Kind == "bool" {
+			w("        %v)\n", opt)
+			w("            %v=true\n", shellVarName(k))
+			w("            shift\n")
+			w("            ;;\n")
+			w("        --no-%v)\n", k)
+			w("            %v=false\n", shellVarName(k))
+			w("            shift\n")
+			w("            ;;\n")
+		} else {
+			w("        %v)\n", opt)
+			w("            [ $# -gt 1 ] || cb_die \"missing argument for '$1'\"\n")
+			w("            %v\n", set("$2"))
+			w("            shift 2\n")
+			w("            ;;\n")
+		}
+		w("        %v=*)\n", strings.Replace(opt, "|", "=*|", -1))
+		w("            %v\n", set("${1#*=}"))
+		w("            shift\n")
+		w("            ;;\n")
+	}
+	w("        *)\n")
+	if len(rks) > 0 {
+		vo := []string{}
+		for _, k := range rks {
+			vo = append(vo, "--"+k)
+		}
+		w("            cb_die \"invalid option specified '$1', valid options are %v\"\n", vo)
+	} else {
+		w("            cb_die \"invalid option specified '$1', there are no valid options\"\n")
+	}
+	w("            ;;\n")
+	w("    esac\n")
+	w("done\n")
+	for _, k := range rks {
+		if recipe.Decls[k].Secret && rvs[k] == "" {
+			// prompt without echo before the defaults reference it, like cb
+			w("if [ -z \"${%v}\" ] && [ -t 0 ] ; then\n", shellVarName(k))
+			w("    read -r -s -p '%v: ' %v\n", k, shellVarName(k))
+			w("    echo >&2\n")
+			w("fi\n")
+		}
+	}
+	order, err := orderRecipeVariables(recipe, nil)
+	if err != nil {
+		return
+	}
+	dvars := map[string]string{} // with the temporary variables for the defaults
+	for k, v := range recipe.Variables {
+		dvars[k] = v
+	}
+	for _, k := range order {
+		w("if [ -z \"${%v+x}\" ] ; then\n", shellVarName(k))
+		data, lines := shellExpandRefs(rvs[k], "var-"+k, dvars)
+		for _, line := range lines {
+			w("    %v\n", line)
+		}
+		// The sources are computed like cb computes them.
+		kind, arg := parseVariableSource(data)
+		switch kind {
+		case "cmd":
+			w("    %v=\"$(%v)\" || cb_die \"invalid value for --%v: command failed\"\n", shellVarName(k), shellCodeWithVars(arg, dvars), k)
+		case "file":
+			path := shellQuoteWithVars(arg, dvars)
+			if arg == "~" || strings.HasPrefix(arg, "~/") {
+				path = "\"${HOME}\"" + shellQuoteWithVars(arg[1:], dvars)
+			}
+			w("    %v=\"$(cat %v)\" || cb_die \"invalid value for --%v: cannot read file\"\n", shellVarName(k), path, k)
+		case "env":
+			w("    [ -n \"${%v+x}\" ] || cb_die \"invalid value for --%v: environment variable '%v' is not set\"\n", arg, k, arg)
+			w("    %v=\"${%v}\"\n", shellVarName(k), arg)
+		default:
+			w("    %v=%v\n", shellVarName(k), shellQuoteWithVars(data, dvars))
+		}
+		w("fi\n")
+	}
+	for _, k := range rks {
+		w("[ -n \"${%v}\" ] || cb_die \"option '--%v' has no value\"\n", shellVarName(k), k)
+	}
+	w("export %vARGS\n", prefix)
+
+	// The foreach loop variables can be referenced like recipe variables.
+	vars := map[string]string{}
+	for k, v := range recipe.Variables {
+		vars[k] = v
+	}
+	for _, step := range append(recipe.Steps, recipe.Finally...) {
+		if step.Directive == stepForeach {
+			vars[strings.Fields(step.Data)[0]] = ""
+		}
+	}
+	if len(recipe.Finally) > 0 {
+		vars[prefix+"STATUS"] = ""
+	}
+	vars[prefix+"ARGS"] = ""
+
+	// Steps.
+	if len(recipe.Finally) > 0 {
+		// The cleanup steps run from an EXIT trap so that they run even
+		// if a step fails or the script is interrupted. A failing cleanup
+		// step stops the cleanup and sets the exit status.
+		w("\n")
+		w("# Cleanup steps, they always run.\n")
+		w("cb_finally() {\n")
+		w("cb_rc=$?\n")
+		w("trap - EXIT\n")
+		w("case ${cb_rc} in\n")
+		w("    0) %vSTATUS=passed ;;\n", prefix)
+		w("    124) %vSTATUS=timeout ;;\n", prefix)
+		w("    130|143) %vSTATUS=interrupted ;;\n", prefix)
+		w("    *) %vSTATUS=failed ;;\n", prefix)
+		w("esac\n")
+		w("export %vSTATUS\n", prefix)
+		w("set -e\n")
+		if err = shellSteps(&buf, recipe, recipe.Finally, "Finally Step", "finally-", vars); err != nil {
+			return
+		}
+		w("exit ${cb_rc}\n")
+		w("}\n")
+		w("trap cb_finally EXIT\n")
+		w("trap 'exit 130' INT\n")
+		w("trap 'exit 143' TERM\n")
+	}
+	if err = shellSteps(&buf, recipe, recipe.Steps, "Step", "", vars); err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(opts.ShellScript, buf.Bytes(), 0755)
+	if err != nil {
+		err = fmt.Errorf("unable to create file %v - %v", opts.ShellScript, err)
+		return
+	}
+	Log.Info("done")
+	return
+}
+
+// shellSteps writes the commands for the steps of a section. The label
+// is used in the step comments and the tag makes the anonymous script
+// file names unique.
+//
+// The steps in a parallel block run as background jobs, the output of
+// each one is captured and reported when the block ends. The fail-fast
+// policy is not supported, all of the steps are run.
+func shellSteps(buf *bytes.Buffer, recipe RecipeInfo, steps []RecipeStep, label string, tag string, vars map[string]string) error {
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	w := func(f string, a ...interface{}) {
+		fmt.Fprintf(buf, f, a...)
+	}
+	pmax := 0 // maximum number of jobs, non-zero in a parallel block
+	for i, step := range steps {
+		w("\n")
+		w("# %v %v of %v - line %v in %v\n", label, i+1, len(steps), step.Line.lineno, step.Line.fi.abspath)
+		data, lines := shellExpandRefs(step.Data, fmt.Sprintf("%vref%v", tag, i+1), vars)
+		for _, line := range lines {
+			w("%v\n", line)
+		}
+		step.Data = data
+		q := shellQuoteWithVars(step.Data, vars)
+		if pmax > 0 && step.Directive != stepEndparallel {
+			cmd := shellTimeout(step) + shellCommand(step.Data, vars)
+			switch step.Directive {
+			case stepExecNoExit:
+				cmd += " || true"
+			case stepScript:
+				cmd = fmt.Sprintf("\"${%vSCRIPTS}/${%vPID}-%v%v.sh\"", prefix, prefix, tag, i+1)
+				w("mkdir -p \"${%vSCRIPTS}\"\n", prefix)
+				w("cat >%v <<CB_SCRIPT_%v_EOF\n", cmd, i+1)
+				w("%v\n", shellHeredocWithVars(step.Data, vars))
+				w("CB_SCRIPT_%v_EOF\n", i+1)
+				w("chmod 0700 %v\n", cmd)
+				w("cb_scripts+=(%v)\n", cmd)
+				cmd = shellTimeout(step) + cmd
+			}
+			w("cb_parallel_wait %v\n", pmax)
+			w("cb_out=\"$(mktemp)\"\n")
+			w("( %v ) >\"${cb_out}\" 2>&1 &\n", cmd)
+			w("cb_pids+=($!)\n")
+			w("cb_outs+=(\"${cb_out}\")\n")
+			w("cb_steps+=(%v)\n", i+1)
+			continue
+		}
+		switch step.Directive {
+		case stepCd:
+			w("cd %v || cb_die \"failed to change directory to \"%v\n", q, q)
+		case stepExec:
+			w("cb_run %v%v\n", shellTimeout(step), shellCommand(step.Data, vars))
+		case stepExecNoExit:
+			w("cb_run %v%v || true\n", shellTimeout(step), shellCommand(step.Data, vars))
+		case stepExport:
+			flds := strings.SplitN(step.Data, "=", 2)
+			w("export %v=%v\n", flds[0], shellQuoteWithVars(flds[1], vars))
+		case stepInfo:
+			w("printf '%%s\\n' %v\n", q)
+		case stepMustExistDir:
+			w("[ -d %v ] || cb_die \"directory does not exist: \"%v\n", q, q)
+		case stepMustExistFile:
+			w("[ -f %v ] || cb_die \"file does not exist: \"%v\n", q, q)
+		case stepMustNotExistDir:
+			w("[ ! -d %v ] || cb_die \"directory exists: \"%v\n", q, q)
+		case stepMustNotExistFile:
+			w("[ ! -f %v ] || cb_die \"file exists: \"%v\n", q, q)
+		case stepScript:
+			eof := fmt.Sprintf("CB_SCRIPT_%v_EOF", i+1)
+			w("mkdir -p \"${%vSCRIPTS}\"\n", prefix)
+			w("cb_script=\"${%vSCRIPTS}/${%vPID}-%v%v.sh\"\n", prefix, prefix, tag, i+1)
+			w("cat >\"${cb_script}\" <<%v\n", eof)
+			w("%v\n", shellHeredocWithVars(step.Data, vars))
+			w("%v\n", eof)
+			w("chmod 0700 \"${cb_script}\"\n")
+			w("%v\"${cb_script}\" | tee \"${cb_script}.out\"\n", shellTimeout(step))
+			w("cb_exports \"${cb_script}.out\"\n")
+			w("rm -f \"${cb_script}\" \"${cb_script}.out\"\n")
+		case stepIfVarSet:
+			w("if [ -n \"${%v}\" ] ; then\n", shellVarName(step.Data))
+			w("    :\n")
+		case stepIfFileExists:
+			w("if [ -e %v ] ; then\n", q)
+			w("    :\n")
+		case stepIfEnv:
+			flds := strings.SplitN(step.Data, "=", 2)
+			if len(flds) == 1 {
+				w("if [ -n \"${%v+x}\" ] ; then\n", flds[0])
+			} else {
+				w("if [ -n \"${%v+x}\" ] && [ \"${%v}\" = %v ] ; then\n", flds[0], flds[0], shellQuoteWithVars(flds[1], vars))
+			}
+			w("    :\n")
+		case stepIfOs:
+			w("if [[ \" \"%v\" \" == *\" $(uname -s | tr '[:upper:]' '[:lower:]') \"* ]] ; then\n", q)
+			w("    :\n")
+		case stepElse:
+			w("else\n")
+			w("    :\n")
+		case stepEndif:
+			w("fi\n")
+		case stepForeach:
+			w("for %v in %v ; do\n", shellVarName(strings.Fields(step.Data)[0]), shellLoopItems(step.Data, vars))
+			w("    :\n")
+		case stepEndforeach:
+			w("done\n")
+		case stepParallel:
+			pmax, _, _ = parseParallelOptions(step.Data)
+			w("cb_pids=()\n")
+			w("cb_outs=()\n")
+			w("cb_steps=()\n")
+			w("cb_scripts=()\n")
+		case stepEndparallel:
+			pmax = 0
+			w("cb_status=0\n")
+			w("for cb_i in \"${!cb_pids[@]}\" ; do\n")
+			w("    wait \"${cb_pids[${cb_i}]}\" || cb_status=$?\n")
+			w("    sed \"s/^/[step ${cb_steps[${cb_i}]}] /\" \"${cb_outs[${cb_i}]}\"\n")
+			w("    cb_exports \"${cb_outs[${cb_i}]}\"\n")
+			w("    rm -f \"${cb_outs[${cb_i}]}\"\n")
+			w("done\n")
+			w("[ ${#cb_scripts[@]} -eq 0 ] || rm -f \"${cb_scripts[@]}\"\n")
+			w("[ ${cb_status} -eq 0 ] || cb_die \"parallel step failed (${cb_status})\"\n")
+		default:
+			return newStepError(step, i+1, "unrecognized directive %v (%v)", step.Directive, step.DirectiveString)
+		}
+	}
+	return nil
+}
+
+// shellTimeout returns the command prefix for a step with timeout or
+// retry modifiers.
+func shellTimeout(step RecipeStep) (s string) {
+	if step.Retry > 0 {
+		s += fmt.Sprintf("cb_retry %v %v ", step.Retry, step.Backoff.Seconds())
+	}
+	if step.Timeout > 0 {
+		s += fmt.Sprintf("timeout %v ", step.Timeout.Seconds())
+	}
+	return
+}
+
+// shellVarName maps a recipe variable name to a shell variable name.
+// The built-in environment variables keep their names, recipe variables
+// get a prefix to avoid collisions and dashes are mapped to underscores.
+func shellVarName(name string) string {
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return "cb_" + strings.Replace(name, "-", "_", -1)
+}
+
+// shellSafeRegexp matches strings that do not need quoting.
+var shellSafeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./\-]+$`)
+
+// shellQuoteLiteral single quotes a string for bash if necessary.
+func shellQuoteLiteral(s string) string {
+	if shellSafeRegexp.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteWithVars quotes a string for bash. Literal text is single
+// quoted and recipe variable references are double quoted so that they
+// are expanded when the script runs. Escaped references are literal.
+func shellQuoteWithVars(s string, vars map[string]string) string {
+	if s == "" {
+		return "''"
+	}
+	var buf bytes.Buffer
+	p := 0
+	for _, r := range shellPlainRefs(s, vars) {
+		if r.start > p {
+			buf.WriteString(shellQuoteLiteral(unescapeVariableRefs(s[p:r.start])))
+		}
+		fmt.Fprintf(&buf, "\"${%v}\"", shellVarName(r.name))
+		p = r.end
+	}
+	if p < len(s) {
+		buf.WriteString(shellQuoteLiteral(unescapeVariableRefs(s[p:])))
+	}
+	return buf.String()
+}
+
+// shellCommand converts the data for an exec step to a bash command.
+// The data is tokenized the same way that RunCmdContext does it so that
+// the arguments are identical. The quotes are checked before they are
+// removed. The variable references in an unquoted token are not quoted
+// so that their values are split into separate arguments just like they
+// are when the recipe is run by cb, where the values are substituted
+// before the command is split. A quoted reference, like "${name}", is a
+// single argument.
+func shellCommand(data string, vars map[string]string) string {
+	tokens, quoted := tokenizeWords(data)
+	args := []string{}
+	for i, token := range tokens {
+		switch {
+		case quoted[i]:
+			args = append(args, shellQuoteWithVars(token, vars))
+		case token == "${"+strings.ToUpper(Context.Base)+"_ARGS}":
+			// the pass through arguments are kept intact
+			args = append(args, "\"${cb_args[@]}\"")
+		default:
+			args = append(args, shellSplitWithVars(token, vars))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// shellSplitWithVars quotes a string for bash like shellQuoteWithVars but
+// the recipe variable references are not quoted so that their values are
+// split on white space.
+func shellSplitWithVars(s string, vars map[string]string) string {
+	refs := shellPlainRefs(s, vars)
+	if len(refs) == 0 {
+		return shellQuoteWithVars(s, vars)
+	}
+	var buf bytes.Buffer
+	p := 0
+	for _, r := range refs {
+		if r.start > p {
+			buf.WriteString(shellQuoteLiteral(unescapeVariableRefs(s[p:r.start])))
+		}
+		fmt.Fprintf(&buf, "${%v}", shellVarName(r.name))
+		p = r.end
+	}
+	if p < len(s) {
+		buf.WriteString(shellQuoteLiteral(unescapeVariableRefs(s[p:])))
+	}
+	return buf.String()
+}
+
+// shellHeredocWithVars escapes a string for an unquoted heredoc so that
+// only the recipe variable references are expanded. An escaped reference
+// is written as ${name} for the script.
+func shellHeredocWithVars(s string, vars map[string]string) string {
+	var buf bytes.Buffer
+	esc := func(t string) {
+		t = unescapeVariableRefs(t)
+		t = strings.Replace(t, `\`, `\\`, -1)
+		t = strings.Replace(t, "$", `\$`, -1)
+		t = strings.Replace(t, "`", "\\`", -1)
+		buf.WriteString(t)
+	}
+	p := 0
+	for _, r := range shellPlainRefs(s, vars) {
+		esc(s[p:r.start])
+		fmt.Fprintf(&buf, "${%v}", shellVarName(r.name))
+		p = r.end
+	}
+	esc(s[p:])
+	return buf.String()
+}
+
+// shellCodeWithVars converts a string that is bash code, like the command
+// of a $(cmd) variable source, by replacing the recipe variable
+// references with the shell variables. The rest is not escaped.
+func shellCodeWithVars(s string, vars map[string]string) string {
+	var buf bytes.Buffer
+	p := 0
+	for _, r := range shellPlainRefs(s, vars) {
+		buf.WriteString(unescapeVariableRefs(s[p:r.start]))
+		fmt.Fprintf(&buf, "${%v}", shellVarName(r.name))
+		p = r.end
+	}
+	buf.WriteString(unescapeVariableRefs(s[p:]))
+	return buf.String()
+}
+
+// shellLoopItems converts the items of a foreach step to a bash word
+// list. Lone variable references are not quoted so that they are split
+// on white space and commas like they are when the recipe is run by cb.
+func shellLoopItems(data string, vars map[string]string) string {
+	items := []string{}
+	flds := strings.Fields(strings.Replace(data, ",", " ", -1))
+	for _, item := range flds[2:] {
+		if name, ok := shellLoneRef(item, vars); ok {
+			items = append(items, fmt.Sprintf("${%v//,/ }", shellVarName(name)))
+			continue
+		}
+		items = append(items, shellQuoteWithVars(item, vars))
+	}
+	return strings.Join(items, " ")
+}
+
+// shellPlainRefs returns the plain references to recipe variables in a
+// string. The other references are literal text, the references with
+// operators are replaced by shellExpandRefs before this is called.
+func shellPlainRefs(s string, vars map[string]string) (refs []variableRef) {
+	for _, r := range scanVariableRefs(s) {
+		if _, ok := vars[r.name]; ok && r.op == "" {
+			refs = append(refs, r)
+		}
+	}
+	return
+}
+
+// shellLoneRef reports whether a string is a lone plain reference to a
+// recipe variable and returns the name.
+func shellLoneRef(s string, vars map[string]string) (string, bool) {
+	refs := shellPlainRefs(s, vars)
+	if len(refs) == 1 && refs[0].start == 0 && refs[0].end == len(s) {
+		return refs[0].name, true
+	}
+	return "", false
+}
+
+// shellExpandRefs replaces the references with operators and the
+// environment variable references in the data of a step by references to
+// temporary variables. It returns the assignments for the temporary
+// variables, they are written before the step so that the expansions are
+// always done in double quotes where the bash syntax of the operators is
+// the same. The temporary variables are added to vars.
+func shellExpandRefs(data string, id string, vars map[string]string) (string, []string) {
+	var buf bytes.Buffer
+	lines := []string{}
+	p := 0
+	for _, r := range scanVariableRefs(data) {
+		if _, ok := vars[r.name]; (ok && r.op == "") || (ok == false && r.env() == false) {
+			continue
+		}
+		name := fmt.Sprintf("_%v_%v", id, len(lines)+1)
+		vars[name] = ""
+		lines = append(lines, fmt.Sprintf("%v=\"%v\"", shellVarName(name), shellRefExpr(r, vars)))
+		buf.WriteString(data[p:r.start])
+		fmt.Fprintf(&buf, "${%v}", name)
+		p = r.end
+	}
+	buf.WriteString(data[p:])
+	return buf.String(), lines
+}
+
+// shellRefExpr converts a reference to a bash parameter expansion for a
+// double quoted string.
+func shellRefExpr(r variableRef, vars map[string]string) string {
+	name := shellVarName(r.name)
+	if r.env() {
+		name = r.name[4:]
+	}
+	switch r.op {
+	case "", "^^", ",,":
+		return "${" + name + r.op + "}"
+	case ":-", ":?":
+		return "${" + name + r.op + shellRefArg(r.arg, vars, false) + "}"
+	case "/", "//":
+		return "${" + name + r.op + shellRefArg(r.arg, vars, true) + "/" + shellRefArg(r.arg2, vars, false) + "}"
+	}
+	return "${" + name + r.op + shellRefArg(r.arg, vars, true) + "}"
+}
+
+// shellRefArg escapes an operator argument so that it is literal text
+// except for the references in it. The pattern characters are escaped
+// for the arguments that bash treats as patterns.
+func shellRefArg(s string, vars map[string]string, pattern bool) string {
+	var buf bytes.Buffer
+	esc := func(t string) {
+		for _, c := range unescapeVariableRefs(t) {
+			if strings.ContainsRune("\\\"$`}&", c) || (pattern && strings.ContainsRune("*?[", c)) {
+				buf.WriteRune('\\')
+			}
+			buf.WriteRune(c)
+		}
+	}
+	p := 0
+	for _, r := range scanVariableRefs(s) {
+		if _, ok := vars[r.name]; ok == false && r.env() == false {
+			continue
+		}
+		esc(s[p:r.start])
+		buf.WriteString(shellRefExpr(r, vars))
+		p = r.end
+	}
+	esc(s[p:])
+	return buf.String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestShellScriptArgs runs a recipe with cb and with its -s script and
+// compares the output. The references must be split the same way.
+func TestShellScriptArgs(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+	recipe := testLoadRecipe(t, `[description]
+brief = args
+full = args
+
+[variable]
+msg = fix the bug
+
+[step]
+step = exec printf "<%s>\n" "${msg}"
+step = exec printf "<%s>\n" ${msg}
+step = exec printf "<%s>\n" '${msg}' x${msg} "x ${msg}"
+step = exec printf "<%s>\n" ${CB_ARGS}
+step = exec printf "<%s>\n" "${CB_ARGS}"
+step = exec printf "<%s>\n" *.none ${msg}
+`)
+	args := []string{"--", "a b", "it's", "*", ""}
+	want, err := testRunRecipe(t, recipe, args...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fn := filepath.Join(t.TempDir(), "test.sh")
+	if err := runRecipeShellScript(CliOptions{Recipe: recipe.File, ShellScript: fn}); err != nil {
+		t.Fatalf("runRecipeShellScript: %v", err)
+	}
+	cmd := exec.Command("bash", append([]string{fn}, args...)...)
+	cmd.Env = append(os.Environ(), "CB_ARGS=")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	if string(out) != want {
+		t.Errorf("the script output is different\ncb:\n%v\nscript:\n%v", want, string(out))
+	}
+}
@@ -39,28 +39,6 @@ func IsFile(path string) bool {
 	return fi.IsDir() == false
 }
 
-// MkdirAll makes all directories in the path.
-func MkdirAll(path string, mode os.FileMode) {
-	// If it already exists, don't bother.
-	if IsDir(path) {
-		return
-	}
-	// Make the directory if it does not exist.
-	if err := os.MkdirAll(path, mode); err != nil {
-		Log.ErrWithLevel(3, "mkdir operation failed for '%v': %v", path, err)
-	}
-}
-
-// Chdir changes the directory.
-func Chdir(path string) {
-	Log.InfoWithLevel(3, "cd to %v", path)
-	if err := os.Chdir(path); err != nil {
-		Log.ErrWithLevel(3, "failed to change directory to %v", path)
-	}
-	wd, _ := os.Getwd()
-	Log.InfoWithLevel(3, "pwd = %v", wd)
-}
-
 // RepoProject contains the information for a repo project.
 type RepoProject struct {
 	name    string
@@ -149,80 +127,72 @@ func GetExePath(f string) (a string, e error) {
 }
 
 // TokenizeString - Dumb tokenizer for shell commands.
-// It only recognizes white space and quotes.
+// It only recognizes white space, quotes and backslashes. A word can be
+// made of quoted and unquoted parts, like 'it'\''s', and the quotes are
+// removed the way the shell does it. Text in single quotes is literal,
+// text in double quotes is unquoted like a Go string so escapes like \n
+// work. Outside of quotes a backslash escapes a quote, a backslash or
+// white space, before any other character it is kept.
 func TokenizeString(text string) (tokens []string) {
-	// Use two character modes to make it impossible to match
-	// a single character.
-	const WS = "ws"     // any whitespace
-	const ACCEPT = "ac" // anything after a backslash
-	const ESC = "\\"    // my editor complains about common strings
-
-	// mode can be one of WS, ACCEPT, single-quote or double-quote.
-	mode := WS
+	tokens, _ = tokenizeWords(text)
+	return
+}
 
-	// Tokens are captured in an array of strings.
-	token := ""
-	pch := "" // previous character
-	pm := ""  // previous mode
-	for i, c := range text {
-		ch := string(text[i])
-		switch mode {
-		case WS:
-			if unicode.IsSpace(c) {
-				if len(token) > 0 {
-					tokens = append(tokens, token)
-					token = ""
-				}
-			} else {
-				// not a space, check for a quote.
-				switch ch {
-				case "'":
-					mode = ch
-				case "\"":
-					mode = ch
-				case ESC:
-					token += ESC
-					pm = mode
-					mode = ACCEPT
-				default:
-					token += ch
+// tokenizeWords tokenizes a string like TokenizeString. It also reports
+// which tokens have a quoted or escaped part, quoted[i] is true if
+// tokens[i] would not be split further by the shell.
+func tokenizeWords(text string) (tokens []string, quoted []bool) {
+	rs := []rune(text)
+	token := []rune{}
+	in := false // in a token, it can be empty like ''
+	q := false  // the token has a quoted part
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			if in {
+				tokens = append(tokens, string(token))
+				quoted = append(quoted, q)
+				token = []rune{}
+				in, q = false, false
+			}
+		case c == '\'':
+			// Everything up to the next single quote is literal.
+			j := i + 1
+			for j < len(rs) && rs[j] != '\'' {
+				j++
+			}
+			token = append(token, rs[i+1:j]...)
+			i = j
+			in, q = true, true
+		case c == '"':
+			// Skip the escaped characters to find the closing quote.
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
 				}
+				j++
 			}
-		case ch:
-			// symmetric delimiter like " or '.
-			if pch == ESC {
-				token += ch
-			} else {
-				t := ch + token + ch
-				tokens = append(tokens, t)
-				token = ""
-				mode = WS
+			raw := string(rs[i+1 : j])
+			if s, err := strconv.Unquote("\"" + raw + "\""); err == nil {
+				raw = s
 			}
-		case ACCEPT:
-			// Accept anything after an escape.
-			token += ch
-			mode = pm
+			token = append(token, []rune(raw)...)
+			i = j
+			in, q = true, true
+		case c == '\\' && i+1 < len(rs) && (strings.ContainsRune("'\"\\", rs[i+1]) || unicode.IsSpace(rs[i+1])):
+			i++
+			token = append(token, rs[i])
+			in, q = true, true
 		default:
-			// Everything else.
-			token += ch
-			if ch == ESC {
-				// Handle the special case of escape sequences.
-				pm = mode
-				mode = ACCEPT
-			}
+			token = append(token, c)
+			in = true
 		}
-		pch = ch
 	}
-	if len(token) > 0 {
-		tokens = append(tokens, token)
+	if in {
+		tokens = append(tokens, string(token))
+		quoted = append(quoted, q)
 	}
-
-	// Final pass to fix things up.
-	for i, arg := range tokens {
-		if arg[0] == '"' {
-			tokens[i], _ = strconv.Unquote(arg)
-		}
-	}
-
 	return
 }
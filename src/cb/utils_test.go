@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeString(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{`echo a  b`, []string{"echo", "a", "b"}},
+		{`echo "a b" c`, []string{"echo", "a b", "c"}},
+		{`echo "a\tb\n"`, []string{"echo", "a\tb\n"}},
+		{`echo "say \"hi\""`, []string{"echo", `say "hi"`}},
+		{`echo 'a b'`, []string{"echo", "a b"}},
+		{`echo 'a\nb'`, []string{"echo", `a\nb`}},
+		{`echo 'it'\''s'`, []string{"echo", "it's"}},
+		{`echo --opt='a b'x`, []string{"echo", "--opt=a bx"}},
+		{`echo '' ""`, []string{"echo", "", ""}},
+		{`grep a\.b a\ b`, []string{"grep", `a\.b`, "a b"}},
+		{`echo héllo 'wörld'`, []string{"echo", "héllo", "wörld"}},
+		{`echo 'open`, []string{"echo", "open"}},
+	}
+	for _, tt := range tests {
+		got := TokenizeString(tt.text)
+		if reflect.DeepEqual(got, tt.want) == false {
+			t.Errorf("TokenizeString(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTokenizeStringShellQuote(t *testing.T) {
+	// The values that shellQuoteLiteral quotes must come back unchanged.
+	for _, s := range []string{"hello world", "it's", `a"b`, `back\slash`, "$HOME", "", "tab\there"} {
+		got := TokenizeString(shellQuoteLiteral(s))
+		if len(got) != 1 || got[0] != s {
+			t.Errorf("TokenizeString(shellQuoteLiteral(%q)) = %q", s, got)
+		}
+	}
+}
+
+func TestTokenizeWordsQuoted(t *testing.T) {
+	tokens, quoted := tokenizeWords(`echo ${a} "${a}" '${a}' x${a} a\ b ''`)
+	want := []bool{false, false, true, true, false, true, true}
+	if len(tokens) != len(want) || reflect.DeepEqual(quoted, want) == false {
+		t.Errorf("tokenizeWords: %q %v, want %v", tokens, quoted, want)
+	}
+}
@@ -0,0 +1,371 @@
+// Recipe variable declarations and types.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RecipeVariable is the declaration of a recipe variable. The value is
+// stored in RecipeInfo.Variables because it changes as the recipe runs.
+type RecipeVariable struct {
+	Name   string
+	Type   VariableType
+	Doc    string   // description for the generated OPTIONS help
+	Short  string   // optional single letter option, like j for -j
+	List   bool     // repeated options accumulate values
+	Secret bool     // the value is masked in the output
+	Source string   // cmd, file or env if the default value is computed
+	Line   LineInfo // where the variable was declared
+}
+
+// VariableType is the type of a variable. The value of a variable with
+// a type is validated before the recipe runs. The zero value is an
+// untyped variable that accepts any value.
+type VariableType struct {
+	Kind    string         // int, bool, path, dir, file, enum or regex
+	Choices []string       // the enum values
+	Regexp  *regexp.Regexp // the regex pattern
+	Spec    string         // the type as it was declared
+}
+
+// String returns the type as it was declared.
+func (t VariableType) String() string {
+	return t.Spec
+}
+
+// parseVariableType parses a type declaration:
+//     int             an integer
+//     bool            true, false, yes, no, on, off, 1 or 0
+//     path            a file system path, it does not have to exist
+//     dir             an existing directory
+//     file            an existing file
+//     enum(a|b|c)     one of the values
+//     regex(RE)       a value that RE matches completely
+func parseVariableType(spec string) (t VariableType, err error) {
+	t.Spec = spec
+	switch spec {
+	case "int", "bool", "path", "dir", "file":
+		t.Kind = spec
+		return
+	}
+	switch {
+	case strings.HasPrefix(spec, "enum(") && strings.HasSuffix(spec, ")"):
+		t.Kind = "enum"
+		for _, c := range strings.Split(spec[5:len(spec)-1], "|") {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				err = fmt.Errorf("empty value in type '%v'", spec)
+				return
+			}
+			t.Choices = append(t.Choices, c)
+		}
+	case strings.HasPrefix(spec, "regex(") && strings.HasSuffix(spec, ")"):
+		t.Kind = "regex"
+		re, e := regexp.Compile("^(?:" + spec[6:len(spec)-1] + ")$")
+		if e != nil {
+			err = fmt.Errorf("invalid pattern in type '%v': %v", spec, e)
+			return
+		}
+		t.Regexp = re
+	default:
+		err = fmt.Errorf("unknown type '%v', expected int, bool, path, dir, file, enum(a|b|c) or regex(RE)", spec)
+	}
+	return
+}
+
+// Check reports whether a value is valid for the type.
+func (t VariableType) Check(value string) error {
+	switch t.Kind {
+	case "int":
+		if _, e := strconv.ParseInt(value, 10, 64); e != nil {
+			return fmt.Errorf("not an int")
+		}
+	case "bool":
+		if _, ok := parseVariableBool(value); ok == false {
+			return fmt.Errorf("not a bool, expected true or false")
+		}
+	case "path":
+		if strings.Contains(value, "\x00") {
+			return fmt.Errorf("not a valid path")
+		}
+	case "dir":
+		if IsDir(value) == false {
+			return fmt.Errorf("directory does not exist")
+		}
+	case "file":
+		if IsFile(value) == false {
+			if _, e := os.Stat(value); e == nil {
+				return fmt.Errorf("not a file")
+			}
+			return fmt.Errorf("file does not exist")
+		}
+	case "enum":
+		for _, c := range t.Choices {
+			if value == c {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %v", strings.Join(t.Choices, ", "))
+	case "regex":
+		if t.Regexp.MatchString(value) == false {
+			return fmt.Errorf("does not match the pattern")
+		}
+	}
+	return nil
+}
+
+// parseVariableBool parses the values that a bool variable accepts.
+func parseVariableBool(value string) (b bool, ok bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// envNameRegexp matches a valid environment variable name.
+var envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$`)
+
+// parseVariableSource parses a default value that is computed when the
+// recipe runs:
+//     $(cmd)          the output of a bash command
+//     @file:path      the contents of a file, a leading ~ is expanded
+//     @env:NAME       the value of an environment variable
+// It returns the kind of the source, cmd, file or env, and the argument.
+// The kind is empty if the value is a plain value.
+func parseVariableSource(value string) (kind string, arg string) {
+	switch {
+	case strings.HasPrefix(value, "$(") && strings.HasSuffix(value, ")"):
+		return "cmd", strings.TrimSpace(value[2 : len(value)-1])
+	case strings.HasPrefix(value, "@file:"):
+		return "file", strings.TrimSpace(value[6:])
+	case strings.HasPrefix(value, "@env:"):
+		return "env", strings.TrimSpace(value[5:])
+	}
+	return "", ""
+}
+
+// checkVariableSource reports an error if the argument of a source is
+// not valid. It is called when the recipe is loaded so that the error is
+// reported even if the source is never evaluated.
+func checkVariableSource(kind string, arg string) error {
+	switch {
+	case kind == "cmd" && arg == "":
+		return fmt.Errorf("empty command in variable source '$()'")
+	case kind == "file" && arg == "":
+		return fmt.Errorf("missing path in variable source '@file:'")
+	case kind == "env" && envNameRegexp.MatchString(arg) == false:
+		return fmt.Errorf("invalid environment variable name '%v' in variable source '@env:'", arg)
+	}
+	return nil
+}
+
+// evalVariableSource computes a default value from its source after the
+// references in it have been interpolated. The trailing new lines are
+// removed from the command output and the file contents like the shell
+// does for $(cmd). The command is run by bash in the current directory,
+// its stderr is not captured.
+func evalVariableSource(value string) (string, error) {
+	kind, arg := parseVariableSource(value)
+	switch kind {
+	case "cmd":
+		Log.InfoWithLevel(3, "cmd.cmd = %v", arg)
+		cmd := exec.Command("/bin/bash", "-c", arg)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command '%v' failed: %v", arg, err)
+		}
+		return strings.TrimRight(string(out), "\n"), nil
+	case "file":
+		path := arg
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			path = os.Getenv("HOME") + path[1:]
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot read file '%v': %v", path, err)
+		}
+		return strings.TrimRight(string(data), "\n"), nil
+	case "env":
+		val, ok := os.LookupEnv(arg)
+		if ok == false {
+			return "", fmt.Errorf("environment variable '%v' is not set", arg)
+		}
+		return val, nil
+	}
+	return value, nil
+}
+
+// shortOptionChars are the valid short option names.
+const shortOptionChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// setRecipeVariableAttribute sets an attribute of a variable that was
+// declared earlier in the [variable] section. Attributes are declared
+// as <variable>.<attribute> = <value>:
+//     type     the type of the value, see parseVariableType
+//     doc      the description of the option
+//     short    a single letter option, like j for -j
+//     list     true if repeated options accumulate values
+//     secret   true if the value is masked in the output
+func setRecipeVariableAttribute(rec *RecipeInfo, li LineInfo, key string, value string) error {
+	p := strings.LastIndex(key, ".")
+	name, attr := key[:p], key[p+1:]
+	v, ok := rec.Decls[name]
+	if ok == false {
+		return newParseError(li, "variable '%v' must be declared before its attributes", name)
+	}
+	switch attr {
+	case "type":
+		t, e := parseVariableType(value)
+		if e != nil {
+			return newParseError(li, "%v", e)
+		}
+		v.Type = t
+	case "doc":
+		v.Doc = strings.TrimSpace(value)
+	case "short":
+		if len(value) != 1 || strings.ContainsAny(value, shortOptionChars) == false {
+			return newParseError(li, "invalid short option '%v', expected a single letter or digit", value)
+		}
+		if value == "h" {
+			return newParseError(li, "short option '-h' is reserved for help")
+		}
+		for k, d := range rec.Decls {
+			if k != name && d.Short == value {
+				return newParseError(li, "short option '-%v' is already used by variable '%v'", value, k)
+			}
+		}
+		v.Short = value
+	case "list":
+		b, ok := parseVariableBool(value)
+		if ok == false {
+			return newParseError(li, "invalid list '%v', expected true or false", value)
+		}
+		v.List = b
+	case "secret":
+		b, ok := parseVariableBool(value)
+		if ok == false {
+			return newParseError(li, "invalid secret '%v', expected true or false", value)
+		}
+		v.Secret = b
+	default:
+		return newParseError(li, "unknown variable attribute '%v'", attr)
+	}
+	if v.List && v.Type.Kind == "bool" {
+		return newParseError(li, "bool variable '%v' cannot be a list", name)
+	}
+	if v.Secret && v.Type.Kind == "bool" {
+		return newParseError(li, "bool variable '%v' cannot be a secret", name)
+	}
+	rec.Decls[name] = v
+	return nil
+}
+
+// checkRecipeVariableTypes validates the variable values against their
+// types after the command line options and the variable references have
+// been applied. The skipped variables do not have their values yet.
+func checkRecipeVariableTypes(recipe *RecipeInfo, skip map[string]bool) error {
+	ks := []string{}
+	for k, v := range recipe.Decls {
+		if v.Type.Kind != "" && skip[k] == false {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		v := recipe.Decls[k]
+		vals := []string{recipe.Variables[k]}
+		if v.List {
+			vals = strings.Fields(recipe.Variables[k]) // check each item
+		}
+		for _, val := range vals {
+			if e := v.Type.Check(val); e != nil {
+				if v.Secret {
+					val = secretMask
+				}
+				return &VariableTypeError{Line: v.Line, Name: k, Value: val, Type: v.Type.String(), Msg: e.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// recipeOptionsHelp generates the OPTIONS help for the recipe variables
+// from their declarations. The variables that do not have a doc attribute
+// are flagged so that they are easy to find. It returns an empty string
+// if the recipe does not have any variables.
+func recipeOptionsHelp(recipe RecipeInfo) string {
+	prefix := strings.ToUpper(fmt.Sprintf("%v_", Context.Base))
+	ks := []string{}
+	for k := range recipe.Variables {
+		if strings.HasPrefix(k, prefix) == false {
+			ks = append(ks, k)
+		}
+	}
+	if len(ks) == 0 {
+		return ""
+	}
+	sort.Strings(ks)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "OPTIONS\n")
+	for i, k := range ks {
+		v := recipe.Decls[k]
+		if i > 0 {
+			fmt.Fprintf(&buf, "\n")
+		}
+		arg := strings.ToUpper(strings.Replace(k, "-", "_", -1))
+		if v.Type.Kind == "enum" {
+			arg = strings.Join(v.Type.Choices, "|")
+		}
+		switch {
+		case v.Type.Kind == "bool" && v.Short != "":
+			fmt.Fprintf(&buf, "    -%v, --%v, --no-%v\n", v.Short, k, k)
+		case v.Type.Kind == "bool":
+			fmt.Fprintf(&buf, "    --%v, --no-%v\n", k, k)
+		case v.Short != "":
+			fmt.Fprintf(&buf, "    -%v %v, --%v %v\n", v.Short, arg, k, arg)
+		default:
+			fmt.Fprintf(&buf, "    --%v %v\n", k, arg)
+		}
+		if v.Doc != "" {
+			for _, line := range strings.Split(v.Doc, "\n") {
+				fmt.Fprintf(&buf, "        %v\n", strings.TrimSpace(line))
+			}
+		} else {
+			fmt.Fprintf(&buf, "        Undocumented, add a %v.doc attribute.\n", k)
+		}
+		info := []string{}
+		if v.Type.Kind != "" {
+			info = append(info, fmt.Sprintf("Type: %v.", v.Type))
+		}
+		if v.List {
+			info = append(info, "Can be repeated.")
+		}
+		if v.Secret {
+			info = append(info, "Secret.")
+		}
+		if val := recipe.Variables[k]; val == "" {
+			info = append(info, "Required.")
+		} else if v.Secret && v.Source == "" {
+			info = append(info, fmt.Sprintf("Default: %v.", secretMask))
+		} else if strings.Contains(val, "\n") == false {
+			info = append(info, fmt.Sprintf("Default: %v.", val))
+		}
+		if len(info) > 0 {
+			fmt.Fprintf(&buf, "        %v\n", strings.Join(info, " "))
+		}
+	}
+	return buf.String()
+}